@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	authRealm = "SearchServer"
+
+	scopeUsersRead = "users:read"
+
+	authReasonExpired           = "expired"
+	authReasonMalformed         = "malformed"
+	authReasonBadSignature      = "bad_signature"
+	authReasonInsufficientScope = "insufficient_scope"
+)
+
+// legacyScopes are granted to tokens that carry no scope claim at all.
+var legacyScopes = []string{scopeUsersRead}
+
+type principal struct {
+	Subject string
+	Scopes  []string
+}
+
+func (p *principal) hasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	return slices.Contains(p.Scopes, scope)
+}
+
+type authError struct {
+	Reason string
+	Scope  string
+	// NoToken is set when the request carried no token at all.
+	NoToken bool
+}
+
+func (e *authError) Error() string {
+	if e.Reason == authReasonInsufficientScope {
+		return fmt.Sprintf("%s: %s required", errInsufficientScope, e.Scope)
+	}
+	return fmt.Sprintf("%s: %s", errBadAccessToken, e.Reason)
+}
+
+func (e *authError) Unwrap() error {
+	if e.Reason == authReasonInsufficientScope {
+		return errInsufficientScope
+	}
+	return errBadAccessToken
+}
+
+func (e *authError) statusCode() int {
+	if e.Reason == authReasonInsufficientScope {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// challenge builds the WWW-Authenticate value as described in RFC 6750, section 3.
+// A request without a token gets no error code, see section 3.1.
+func (e *authError) challenge() string {
+	if e.NoToken {
+		return fmt.Sprintf(`Bearer realm=%q`, authRealm)
+	}
+	if e.Reason == authReasonInsufficientScope {
+		return fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope", scope=%q`, authRealm, e.Scope)
+	}
+	return fmt.Sprintf(`Bearer realm=%q, error="invalid_token", error_description=%q`, authRealm, "token "+e.Reason)
+}
+
+// accessToken takes the token from "Authorization: Bearer" (RFC 6750, section 2.1)
+// or from the AccessToken header older clients send.
+func accessToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("AccessToken")
+}
+
+func authCheck(token string, requiredScope string) (*principal, error) {
+	if token == "" {
+		return nil, &authError{Reason: authReasonMalformed, NoToken: true}
+	}
+
+	hashSecretGetter := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return SecretToken, nil
+	}
+
+	claims := jwt.MapClaims{}
+	parsedToken, err := jwt.ParseWithClaims(token, claims, hashSecretGetter)
+	if err != nil {
+		return nil, &authError{Reason: authReasonFromError(err)}
+	}
+	if !parsedToken.Valid {
+		return nil, &authError{Reason: authReasonMalformed}
+	}
+
+	caller := &principal{}
+	caller.Subject, _ = claims["sub"].(string)
+	if rawScope, ok := claims["scope"].(string); ok {
+		caller.Scopes = strings.Fields(rawScope)
+	} else if _, present := claims["scope"]; !present {
+		// Tokens issued before scopes existed keep the read access they always had.
+		caller.Scopes = legacyScopes
+	}
+
+	if requiredScope != "" && !caller.hasScope(requiredScope) {
+		return nil, &authError{Reason: authReasonInsufficientScope, Scope: requiredScope}
+	}
+
+	return caller, nil
+}
+
+func authReasonFromError(err error) string {
+	var validationErr *jwt.ValidationError
+	if !errors.As(err, &validationErr) {
+		return authReasonMalformed
+	}
+
+	switch {
+	case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return authReasonMalformed
+	case validationErr.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+		return authReasonBadSignature
+	case validationErr.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0:
+		return authReasonExpired
+	default:
+		return authReasonMalformed
+	}
+}
+
+func sendAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	authErr := &authError{Reason: authReasonMalformed}
+	errors.As(err, &authErr)
+
+	w.Header().Set("WWW-Authenticate", authErr.challenge())
+	problem := ErrorServer{
+		Error:  errors.Unwrap(authErr).Error(),
+		Code:   codeInvalidToken,
+		Title:  "Invalid AccessToken",
+		Detail: authErr.Error(),
+		Reason: authErr.Reason,
+	}
+	if authErr.Reason == authReasonInsufficientScope {
+		problem.Code, problem.Title = codeInsufficientScope, "Insufficient scope"
+		problem.Allowed = []string{authErr.Scope}
+	}
+	sendJSONError(w, r, problem, authErr.statusCode())
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,11 +29,18 @@ var (
 )
 
 type User struct {
-	ID     int
-	Name   string
-	Age    int
-	About  string
-	Gender string
+	ID   int
+	Name string
+	// части имени, Name составлено из них по шаблону сервера
+	FirstName string
+	LastName  string
+	Age       int
+	About     string
+	Gender    string
+	// заполняются, только если токен дает доступ к персональным данным
+	Email   string
+	Phone   string
+	Address string
 }
 
 type SearchResponse struct {
@@ -38,7 +49,77 @@ type SearchResponse struct {
 }
 
 type SearchErrorResponse struct {
-	Error string
+	Error     string
+	Reason    string
+	Code      string
+	Detail    string
+	Param     string
+	Allowed   []string
+	RequestID string `json:"request_id"`
+
+	InvalidParams []InvalidParam `json:"invalid_params"`
+}
+
+// InvalidParam один отклоненный параметр запроса из ответа 400
+type InvalidParam struct {
+	Name    string
+	Code    string
+	Reason  string
+	Allowed []string
+}
+
+// SearchError ошибка, которую SearchServer описал в формате problem+json (RFC 7807),
+// ей становится любой ответ не из 2xx.
+// Сравнивается через errors.Is по коду: errors.Is(err, ErrBadLimit),
+// а по статусу еще и с ErrAccessToken*, ErrInsufficientScope, ErrUserNotFound и ErrServerFatal
+type SearchError struct {
+	StatusCode int
+	Code       string
+	Param      string
+	Allowed    []string
+	Detail     string
+	RequestID  string
+
+	message string
+	err     error
+}
+
+func (e *SearchError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("SearchServer error %d: %s", e.StatusCode, e.Code)
+}
+
+func (e *SearchError) Is(target error) bool {
+	t, ok := target.(*SearchError)
+	return ok && t.Code != "" && t.Code == e.Code
+}
+
+func (e *SearchError) Unwrap() error {
+	return e.err
+}
+
+// SearchErrors все ошибки валидации из одного ответа, errors.Is и errors.As проверяют каждую из них
+type SearchErrors []*SearchError
+
+func (errs SearchErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs SearchErrors) Unwrap() []error {
+	unwrapped := make([]error, 0, len(errs))
+	for _, err := range errs {
+		unwrapped = append(unwrapped, err)
+	}
+	return unwrapped
 }
 
 const (
@@ -47,6 +128,32 @@ const (
 	OrderByDesc = -1
 
 	ErrorBadOrderField = `OrderField invalid`
+	ErrorBadFields     = `Fields invalid`
+
+	// длиннее этого урла многие прокси уже не пропускают, такие запросы уходят POST-ом
+	maxGETURLLength = 2048
+)
+
+var (
+	ErrBadAccessToken          = errors.New("bad AccessToken")
+	ErrAccessTokenExpired      = fmt.Errorf("%w: token expired", ErrBadAccessToken)
+	ErrAccessTokenMalformed    = fmt.Errorf("%w: token malformed", ErrBadAccessToken)
+	ErrAccessTokenBadSignature = fmt.Errorf("%w: bad token signature", ErrBadAccessToken)
+	ErrInsufficientScope       = errors.New("AccessToken has insufficient scope")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrServerFatal             = errors.New("SearchServer fatal error")
+
+	ErrBadQueryParams = &SearchError{Code: "bad_query_params"}
+	ErrBadRequestBody = &SearchError{Code: "bad_request_body"}
+	ErrBadLimit       = &SearchError{Code: "bad_limit"}
+	ErrBadOffset      = &SearchError{Code: "bad_offset"}
+	ErrBadOrderBy     = &SearchError{Code: "bad_order_by"}
+	ErrBadOrderField  = &SearchError{Code: "bad_order_field"}
+	ErrBadFields      = &SearchError{Code: "bad_fields"}
+	ErrBadFilters     = &SearchError{Code: "bad_filters"}
+	ErrBadLocale      = &SearchError{Code: "bad_locale"}
+	ErrBadID          = &SearchError{Code: "bad_id"}
+	ErrBadIDs         = &SearchError{Code: "bad_ids"}
 )
 
 type SearchRequest struct {
@@ -56,6 +163,20 @@ type SearchRequest struct {
 	OrderField string
 	//  1 по возрастанию, 0 как встретилось, -1 по убыванию
 	OrderBy int
+	// список полей, которые нужно вернуть; пустой - все доступные
+	Fields []string
+	// дополнительные условия, все должны выполняться; с ними запрос уходит POST-ом
+	Filters []SearchFilter
+	// язык (BCP 47, например "sv" или "de"), по правилам которого сортируются имена;
+	// пустой - язык по умолчанию сервера
+	Locale string `json:",omitempty"`
+}
+
+// SearchFilter условие на одно поле: Op - eq, ne, lt, lte, gt, gte, in, contains
+type SearchFilter struct {
+	Field string
+	Op    string
+	Value interface{}
 }
 
 type SearchClient struct {
@@ -63,10 +184,22 @@ type SearchClient struct {
 	AccessToken string
 	// урл внешней системы, куда идти
 	URL string
+	// урл ресурса пользователей для GetUser/GetUsers, по умолчанию вычисляется из URL
+	UsersURL string
+}
+
+type BatchUsersResponse struct {
+	Users    []User
+	NotFound []int
 }
 
 // FindUsers отправляет запрос во внешнюю систему, которая непосредственно ищет пользователей
 func (srv *SearchClient) FindUsers(req SearchRequest) (*SearchResponse, error) {
+	return srv.FindUsersContext(context.Background(), req)
+}
+
+// FindUsersContext то же, что FindUsers, но продолжает трейс из ctx
+func (srv *SearchClient) FindUsersContext(ctx context.Context, req SearchRequest) (*SearchResponse, error) {
 
 	searcherParams := url.Values{}
 
@@ -88,35 +221,27 @@ func (srv *SearchClient) FindUsers(req SearchRequest) (*SearchResponse, error) {
 	searcherParams.Add("query", req.Query)
 	searcherParams.Add("order_field", req.OrderField)
 	searcherParams.Add("order_by", strconv.Itoa(req.OrderBy))
-
-	searcherReq, _ := http.NewRequest("GET", srv.URL+"?"+searcherParams.Encode(), nil) //nolint:errcheck
-	searcherReq.Header.Add("AccessToken", srv.AccessToken)
-
-	resp, err := client.Do(searcherReq)
-	if err != nil {
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return nil, fmt.Errorf("timeout for %s", searcherParams.Encode())
-		}
-		return nil, fmt.Errorf("unknown error %s", err)
+	if len(req.Fields) > 0 {
+		searcherParams.Add("fields", strings.Join(req.Fields, ","))
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body) //nolint:errcheck
-
-	switch resp.StatusCode {
-	case http.StatusUnauthorized:
-		return nil, fmt.Errorf("bad AccessToken")
-	case http.StatusInternalServerError:
-		return nil, fmt.Errorf("SearchServer fatal error")
-	case http.StatusBadRequest:
-		errResp := SearchErrorResponse{}
-		err = json.Unmarshal(body, &errResp)
+	if req.Locale != "" {
+		searcherParams.Add("locale", req.Locale)
+	}
+
+	searcherURL := srv.URL + "?" + searcherParams.Encode()
+	searcherReq, _ := http.NewRequestWithContext(ctx, "GET", searcherURL, nil) //nolint:errcheck
+	if len(req.Filters) > 0 || len(searcherURL) > maxGETURLLength {
+		reqBody, err := json.Marshal(req)
 		if err != nil {
-			return nil, fmt.Errorf("cant unpack error json: %s", err)
-		}
-		if errResp.Error == ErrorBadOrderField {
-			return nil, fmt.Errorf("OrderFeld %s invalid", req.OrderField)
+			return nil, fmt.Errorf("cant pack request json: %s", err)
 		}
-		return nil, fmt.Errorf("unknown bad request error: %s", errResp.Error)
+		searcherReq, _ = http.NewRequestWithContext(ctx, "POST", srv.URL, bytes.NewReader(reqBody)) //nolint:errcheck
+		searcherReq.Header.Set("Content-Type", "application/json")
+	}
+
+	body, err := srv.do(searcherReq, searcherParams.Encode(), &req)
+	if err != nil {
+		return nil, err
 	}
 
 	data := []User{}
@@ -135,3 +260,221 @@ func (srv *SearchClient) FindUsers(req SearchRequest) (*SearchResponse, error) {
 
 	return &result, err
 }
+
+// GetUser получает одного пользователя по ID
+func (srv *SearchClient) GetUser(id int) (*User, error) {
+	return srv.GetUserContext(context.Background(), id)
+}
+
+// GetUserContext то же, что GetUser, но с отменой и трейсом из ctx
+func (srv *SearchClient) GetUserContext(ctx context.Context, id int) (*User, error) {
+	userReq, _ := http.NewRequestWithContext(ctx, "GET", srv.usersURL()+"/"+strconv.Itoa(id), nil) //nolint:errcheck
+
+	body, err := srv.do(userReq, userReq.URL.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	if err = json.Unmarshal(body, user); err != nil {
+		return nil, fmt.Errorf("cant unpack result json: %s", err)
+	}
+	return user, nil
+}
+
+// GetUsers получает пользователей по списку ID за один запрос, ненайденные ID попадают в NotFound
+func (srv *SearchClient) GetUsers(ids []int) (*BatchUsersResponse, error) {
+	return srv.GetUsersContext(context.Background(), ids)
+}
+
+// GetUsersContext то же, что GetUsers, но с отменой и трейсом из ctx
+func (srv *SearchClient) GetUsersContext(ctx context.Context, ids []int) (*BatchUsersResponse, error) {
+	rawIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		rawIDs = append(rawIDs, strconv.Itoa(id))
+	}
+	params := url.Values{}
+	params.Add("ids", strings.Join(rawIDs, ","))
+
+	usersReq, _ := http.NewRequestWithContext(ctx, "GET", srv.usersURL()+"?"+params.Encode(), nil) //nolint:errcheck
+
+	body, err := srv.do(usersReq, params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BatchUsersResponse{}
+	if err = json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("cant unpack result json: %s", err)
+	}
+	return result, nil
+}
+
+func (srv *SearchClient) usersURL() string {
+	if srv.UsersURL != "" {
+		return srv.UsersURL
+	}
+	base := strings.TrimSuffix(srv.URL, "/")
+	if strings.HasSuffix(base, "/users/search") {
+		return strings.TrimSuffix(base, "/search")
+	}
+	return base + "/users"
+}
+
+// do отправляет запрос и обрабатывает ошибки, общие для всех методов клиента.
+// Тело возвращается только для ответов 2xx, searchReq нужен для текста ошибок 400
+func (srv *SearchClient) do(req *http.Request, target string, searchReq *SearchRequest) ([]byte, error) {
+	ctx, span := tracer.Start(req.Context(), "SearchClient "+req.Method)
+	defer span.End()
+	req = req.WithContext(ctx)
+	req.Header.Add("AccessToken", srv.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	// выставляем сами, поэтому и разжимаем сами: транспорт делает это только если заголовок не задан
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set(traceparentHeader, span.SpanContext().traceparent())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		// отмену вызывающим отдаем как есть, чтобы ее можно было проверить через errors.Is
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, fmt.Errorf("request for %s: %w", target, ctxErr)
+		}
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil, fmt.Errorf("timeout for %s", target)
+		}
+		return nil, fmt.Errorf("unknown error %s", err)
+	}
+	defer resp.Body.Close()
+	var respBody io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipBody, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("cant decompress response: %s", err)
+		}
+		defer gzipBody.Close()
+		respBody = gzipBody
+	}
+	body, _ := io.ReadAll(respBody) //nolint:errcheck
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return body, nil
+	case resp.StatusCode == http.StatusBadRequest:
+		return nil, badRequestError(body, searchReq)
+	default:
+		return nil, responseError(resp.StatusCode, body)
+	}
+}
+
+// responseError разбирает ответ не из 2xx в *SearchError, тело может быть и не problem+json
+func responseError(statusCode int, body []byte) error {
+	errResp := SearchErrorResponse{}
+	_ = json.Unmarshal(body, &errResp) //nolint:errcheck
+
+	searchErr := &SearchError{
+		StatusCode: statusCode,
+		Code:       errResp.Code,
+		Param:      errResp.Param,
+		Allowed:    errResp.Allowed,
+		Detail:     errResp.Detail,
+		RequestID:  errResp.RequestID,
+	}
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		searchErr.err = authErrorFromReason(errResp.Reason)
+	case statusCode == http.StatusForbidden:
+		searchErr.err = ErrInsufficientScope
+	case statusCode == http.StatusNotFound && (errResp.Code == "" || errResp.Code == "user_not_found"):
+		// старые версии сервера отвечают 404 без кода
+		searchErr.err = ErrUserNotFound
+	case statusCode >= 500:
+		searchErr.err = ErrServerFatal
+	}
+	return searchErr
+}
+
+// badRequestError разбирает ответ 400 в *SearchError, а если сервер отклонил несколько параметров, в SearchErrors.
+// req нужен для текста ошибок по OrderField и Fields
+func badRequestError(body []byte, req *SearchRequest) error {
+	errResp := SearchErrorResponse{}
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		return fmt.Errorf("cant unpack error json: %s", err)
+	}
+
+	if len(errResp.InvalidParams) > 0 {
+		errs := make(SearchErrors, 0, len(errResp.InvalidParams))
+		for _, invalid := range errResp.InvalidParams {
+			searchErr := &SearchError{
+				StatusCode: http.StatusBadRequest,
+				Code:       invalid.Code,
+				Param:      invalid.Name,
+				Allowed:    invalid.Allowed,
+				Detail:     invalid.Reason,
+				RequestID:  errResp.RequestID,
+			}
+			searchErr.message = badRequestMessage(searchErr, req, fmt.Sprintf("%s: %s", invalid.Name, invalid.Reason))
+			errs = append(errs, searchErr)
+		}
+		if len(errs) == 1 {
+			return errs[0]
+		}
+		return errs
+	}
+
+	searchErr := &SearchError{
+		StatusCode: http.StatusBadRequest,
+		Code:       errResp.Code,
+		Param:      errResp.Param,
+		Allowed:    errResp.Allowed,
+		Detail:     errResp.Detail,
+		RequestID:  errResp.RequestID,
+	}
+	// старые версии сервера присылают только текст ошибки
+	if searchErr.Code == "" && errResp.Error == ErrorBadOrderField {
+		searchErr.Code = ErrBadOrderField.Code
+	}
+	if searchErr.Code == "" && errResp.Error == ErrorBadFields {
+		searchErr.Code = ErrBadFields.Code
+	}
+
+	detail := searchErr.Detail
+	if detail == "" {
+		detail = errResp.Error
+	}
+	if searchErr.Code == "" {
+		searchErr.message = fmt.Sprintf("unknown bad request error: %s", errResp.Error)
+	} else {
+		searchErr.message = badRequestMessage(searchErr, req, detail)
+	}
+	return searchErr
+}
+
+func badRequestMessage(searchErr *SearchError, req *SearchRequest, detail string) string {
+	switch {
+	case searchErr.Code == ErrBadOrderField.Code && req != nil:
+		return fmt.Sprintf("OrderFeld %s invalid", req.OrderField)
+	case searchErr.Code == ErrBadFields.Code && req != nil:
+		return fmt.Sprintf("Fields %s invalid", strings.Join(req.Fields, ","))
+	default:
+		return fmt.Sprintf("bad request error: %s", detail)
+	}
+}
+
+// authErrorFromReason сопоставляет причину отказа в авторизации с одной из ошибок ErrAccessToken*
+func authErrorFromReason(reason string) error {
+	switch reason {
+	case "expired":
+		return ErrAccessTokenExpired
+	case "malformed":
+		return ErrAccessTokenMalformed
+	case "bad_signature":
+		return ErrAccessTokenBadSignature
+	case "insufficient_scope":
+		return ErrInsufficientScope
+	default:
+		return ErrBadAccessToken
+	}
+}
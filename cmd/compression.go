@@ -0,0 +1,228 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const encodingGzip = "gzip"
+
+// compressMinSize is the smallest response body worth compressing, see
+// -compress-min-size. Negative values turn compression off.
+var compressMinSize = 1024
+
+// contentEncoding is a Content-Encoding the server can produce. Writers are
+// pooled because setting up a compressor costs more than a small response.
+type contentEncoding struct {
+	name string
+	pool *sync.Pool
+}
+
+type resettableWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var contentEncodings = []*contentEncoding{
+	{
+		name: encodingGzip,
+		pool: &sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }},
+	},
+}
+
+// negotiateEncoding picks the most preferred encoding from Accept-Encoding,
+// nil means the body goes out as is.
+func negotiateEncoding(r *http.Request) *contentEncoding {
+	preferred, refused := parsePreferences(r.Header.Get("Accept-Encoding"))
+	for _, name := range preferred {
+		for _, encoding := range contentEncodings {
+			if name == encoding.name || name == "*" && !slices.Contains(refused, encoding.name) {
+				return encoding
+			}
+		}
+	}
+	return nil
+}
+
+// withCompression compresses response bodies of at least compressMinSize
+// bytes. Smaller bodies are sent as is, because the compression framing
+// would make them bigger.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r)
+		if encoding == nil || compressMinSize < 0 || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer func() {
+			if p := recover(); p != nil {
+				cw.abort()
+				panic(p)
+			}
+			if err := cw.close(); err != nil {
+				loggerFromContext(r.Context()).Warn("withCompression: Failed to send response", slog.String("error", err.Error()))
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds the status and the start of the body back until it
+// knows whether the body reaches compressMinSize.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding *contentEncoding
+
+	statusCode int
+	buf        []byte
+	decided    bool
+	enc        resettableWriter
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.statusCode == 0 && !cw.decided {
+		cw.statusCode = statusCode
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.statusCode == 0 {
+		cw.statusCode = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < compressMinSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the header and whatever was held back, compressed or not.
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if compress && (header.Get("Content-Encoding") != "" || !bodyAllowed(cw.statusCode)) {
+		compress = false
+	}
+
+	if compress {
+		header.Set("Content-Encoding", cw.encoding.name)
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); etag != "" {
+			header.Set("ETag", encodedETag(etag, cw.encoding.name))
+		}
+		cw.enc = cw.encoding.pool.Get().(resettableWriter)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// encodedETag tells the compressed representation apart from the identity one,
+// a strong ETag must differ between the two (RFC 9110, section 8.8.3).
+// Weak ETags stay as they are.
+func encodedETag(etag, encoding string) string {
+	if strings.HasPrefix(etag, "W/") || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// decodedETag undoes encodedETag, so a validator of either representation
+// names the same version of the resource.
+func decodedETag(etag string) string {
+	for _, encoding := range contentEncodings {
+		if trimmed, ok := strings.CutSuffix(etag, "-"+encoding.name+`"`); ok {
+			return trimmed + `"`
+		}
+	}
+	return etag
+}
+
+func (cw *compressWriter) close() error {
+	if !cw.decided {
+		if cw.statusCode == 0 {
+			return nil
+		}
+		return cw.decide(false)
+	}
+	if cw.enc == nil {
+		return nil
+	}
+
+	err := cw.enc.Close()
+	cw.enc.Reset(io.Discard)
+	cw.encoding.pool.Put(cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// abort drops what the panicking handler left behind. A response held back
+// entirely is not sent at all, so withRecovery can still answer 500. A
+// compressed stream is not finished, the client sees it cut off instead of
+// taking it for the whole body.
+func (cw *compressWriter) abort() {
+	cw.buf = nil
+	if !cw.decided {
+		cw.statusCode = 0
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Reset(io.Discard)
+		cw.encoding.pool.Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// Flush gives up on holding the body back, a streaming handler wants it out now.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.statusCode == 0 {
+			cw.statusCode = http.StatusOK
+		}
+		if err := cw.decide(len(cw.buf) >= compressMinSize); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush() //nolint:errcheck
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush() //nolint:errcheck
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= http.StatusOK && !slices.Contains([]int{http.StatusNoContent, http.StatusNotModified}, statusCode)
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	convertXML      = "xml"
+	convertJSON     = "json"
+	convertJSONL    = "jsonl"
+	convertCSV      = "csv"
+	convertColumnar = "columnar"
+
+	columnInt    byte = 'i'
+	columnBool   byte = 'b'
+	columnString byte = 's'
+
+	maxColumnarValue = 1 << 30
+)
+
+// columnarMagic starts every columnar file, the last byte is the format version.
+var columnarMagic = []byte("SSCOLS\x00\x01")
+
+var errBadColumnarFile = errors.New("bad columnar file")
+
+// datasetRow is a full row of dataset.xml, including the elements the server
+// doesn't serve, so a conversion keeps every field.
+type datasetRow struct {
+	ID            int    `xml:"id" json:"id"`
+	GUID          string `xml:"guid" json:"guid"`
+	IsActive      bool   `xml:"isActive" json:"isActive"`
+	Balance       string `xml:"balance" json:"balance"`
+	Picture       string `xml:"picture" json:"picture"`
+	Age           int    `xml:"age" json:"age"`
+	EyeColor      string `xml:"eyeColor" json:"eyeColor"`
+	FirstName     string `xml:"first_name" json:"first_name"`
+	LastName      string `xml:"last_name" json:"last_name"`
+	Gender        string `xml:"gender" json:"gender"`
+	Company       string `xml:"company" json:"company"`
+	Email         string `xml:"email" json:"email"`
+	Phone         string `xml:"phone" json:"phone"`
+	Address       string `xml:"address" json:"address"`
+	About         string `xml:"about" json:"about"`
+	Registered    string `xml:"registered" json:"registered"`
+	FavoriteFruit string `xml:"favoriteFruit" json:"favoriteFruit"`
+}
+
+// datasetColumn is a field of datasetRow as the column-based formats see it.
+type datasetColumn struct {
+	name  string
+	index int
+	kind  byte
+}
+
+var datasetColumns = rowColumns()
+
+func rowColumns() []datasetColumn {
+	rowType := reflect.TypeOf(datasetRow{})
+	columns := make([]datasetColumn, 0, rowType.NumField())
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		column := datasetColumn{name: field.Tag.Get("xml"), index: i, kind: columnString}
+		switch field.Type.Kind() {
+		case reflect.Int:
+			column.kind = columnInt
+		case reflect.Bool:
+			column.kind = columnBool
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// text is the value of the column in row as CSV writes it.
+func (c datasetColumn) text(row *datasetRow) string {
+	value := reflect.ValueOf(row).Elem().Field(c.index)
+	switch c.kind {
+	case columnInt:
+		return strconv.FormatInt(value.Int(), 10)
+	case columnBool:
+		return strconv.FormatBool(value.Bool())
+	}
+	return value.String()
+}
+
+func (c datasetColumn) setText(row *datasetRow, text string) error {
+	value := reflect.ValueOf(row).Elem().Field(c.index)
+	switch c.kind {
+	case columnInt:
+		if text == "" {
+			return nil
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad %s %q", c.name, text)
+		}
+		value.SetInt(n)
+	case columnBool:
+		if text == "" {
+			return nil
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return fmt.Errorf("bad %s %q", c.name, text)
+		}
+		value.SetBool(b)
+	default:
+		value.SetString(text)
+	}
+	return nil
+}
+
+// datasetCodec reads and writes datasets in one format, a row at a time.
+// With lenient, scan skips and counts the rows a lenient load rejects in the
+// formats the server loads leniently; the others are always read strictly.
+type datasetCodec struct {
+	scan      func(r io.Reader, lenient bool, row func(row *datasetRow) error) (rejected int, err error)
+	newWriter func(w io.Writer) datasetWriter
+}
+
+// datasetWriter writes a dataset row by row, close finishes it.
+type datasetWriter interface {
+	write(row *datasetRow) error
+	close() error
+}
+
+var datasetCodecs = map[string]datasetCodec{
+	convertXML:      {scan: scanXMLDatasetRows, newWriter: newXMLRowWriter},
+	convertJSON:     {scan: scanJSONRows, newWriter: newJSONRowWriter},
+	convertJSONL:    {scan: scanJSONLRows, newWriter: newJSONLRowWriter},
+	convertCSV:      {scan: scanCSVRows, newWriter: newCSVRowWriter},
+	convertColumnar: {scan: scanColumnarRows, newWriter: newColumnarRowWriter},
+}
+
+// read reads all rows of a dataset.
+func (c datasetCodec) read(r io.Reader) ([]datasetRow, error) {
+	rows := []datasetRow{}
+	_, err := c.scan(r, false, func(row *datasetRow) error {
+		rows = append(rows, *row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c datasetCodec) write(w io.Writer, rows []datasetRow) error {
+	out := c.newWriter(w)
+	for i := range rows {
+		if err := out.write(&rows[i]); err != nil {
+			return err
+		}
+	}
+	return out.close()
+}
+
+var convertExtensions = map[string]string{
+	".xml":      convertXML,
+	".json":     convertJSON,
+	".jsonl":    convertJSONL,
+	".ndjson":   convertJSONL,
+	".csv":      convertCSV,
+	".columnar": convertColumnar,
+}
+
+func codecFor(path, format string) (datasetCodec, error) {
+	if format == sourceAuto {
+		format = convertExtensions[strings.ToLower(filepath.Ext(path))]
+		if format == "" {
+			return datasetCodec{}, fmt.Errorf("%w: can't tell the format of %s by its extension", errUnknownSourceFormat, path)
+		}
+	}
+	codec, ok := datasetCodecs[format]
+	if !ok {
+		return datasetCodec{}, fmt.Errorf("%w %q, known formats: %s", errUnknownSourceFormat, format, strings.Join(sortedKeys(datasetCodecs), ", "))
+	}
+	return codec, nil
+}
+
+// scanXMLDatasetRows reads the <row> children of the root element. A row the
+// lenient loader would serve but that doesn't decode as a full row fails a
+// lenient read too, it must not be left out.
+func scanXMLDatasetRows(r io.Reader, lenient bool, row func(row *datasetRow) error) (int, error) {
+	if !lenient {
+		return 0, walkXMLRows(r, func(dec *xml.Decoder, start *xml.StartElement) error {
+			decoded := datasetRow{}
+			if err := dec.DecodeElement(&decoded, start); err != nil {
+				return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+			}
+			return row(&decoded)
+		})
+	}
+
+	rejected := 0
+	err := scanXMLRows(r, func(segment []byte, line, _ int) error {
+		decoded := datasetRow{}
+		err := xml.Unmarshal(segment, &decoded)
+		if err == nil {
+			return row(&decoded)
+		}
+		if segment != nil && xml.Unmarshal(segment, &UserServer{}) == nil {
+			return fmt.Errorf("%w: line %d: %s", errParsingDatasetFailed, line, err)
+		}
+		rejected++
+		return nil
+	})
+	return rejected, err
+}
+
+type xmlRowWriter struct {
+	w       io.Writer
+	enc     *xml.Encoder
+	started bool
+}
+
+func newXMLRowWriter(w io.Writer) datasetWriter {
+	enc := xml.NewEncoder(w)
+	enc.Indent("  ", "  ")
+	return &xmlRowWriter{w: w, enc: enc}
+}
+
+func (x *xmlRowWriter) start() error {
+	if x.started {
+		return nil
+	}
+	x.started = true
+	_, err := io.WriteString(x.w, xml.Header+"<root>\n")
+	return err
+}
+
+func (x *xmlRowWriter) write(row *datasetRow) error {
+	if err := x.start(); err != nil {
+		return err
+	}
+	return x.enc.EncodeElement(row, xml.StartElement{Name: xml.Name{Local: "row"}})
+}
+
+func (x *xmlRowWriter) close() error {
+	if err := x.start(); err != nil {
+		return err
+	}
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(x.w, "\n</root>\n")
+	return err
+}
+
+// scanJSONRows reads a JSON array of rows element by element.
+func scanJSONRows(r io.Reader, _ bool, row func(row *datasetRow) error) (int, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return 0, fmt.Errorf("%w: expected a JSON array of rows", errParsingDatasetFailed)
+	}
+	for n := 1; dec.More(); n++ {
+		decoded := datasetRow{}
+		if err := dec.Decode(&decoded); err != nil {
+			return 0, fmt.Errorf("%w: row %d: %s", errParsingDatasetFailed, n, err)
+		}
+		if err := row(&decoded); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return 0, fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+	}
+	return 0, nil
+}
+
+// jsonRowWriter writes what an indenting json.Encoder writes for the whole
+// slice of rows, one row at a time.
+type jsonRowWriter struct {
+	w    io.Writer
+	rows int
+}
+
+func newJSONRowWriter(w io.Writer) datasetWriter {
+	return &jsonRowWriter{w: w}
+}
+
+func (j *jsonRowWriter) write(row *datasetRow) error {
+	data, err := json.MarshalIndent(row, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if j.rows == 0 {
+		sep = "[\n  "
+	}
+	j.rows++
+	if _, err = io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonRowWriter) close() error {
+	end := "\n]\n"
+	if j.rows == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// scanJSONLRows reads one row per line, blank lines are skipped.
+func scanJSONLRows(r io.Reader, lenient bool, row func(row *datasetRow) error) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+
+	rejected := 0
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		decoded := datasetRow{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			if lenient && json.Unmarshal(data, &UserServer{}) != nil {
+				rejected++
+				continue
+			}
+			return 0, fmt.Errorf("%w: line %d: %s", errParsingDatasetFailed, line, err)
+		}
+		if err := row(&decoded); err != nil {
+			return 0, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+	}
+	return rejected, nil
+}
+
+type jsonlRowWriter struct {
+	enc *json.Encoder
+}
+
+func newJSONLRowWriter(w io.Writer) datasetWriter {
+	return jsonlRowWriter{enc: json.NewEncoder(w)}
+}
+
+func (j jsonlRowWriter) write(row *datasetRow) error {
+	return j.enc.Encode(row)
+}
+
+func (j jsonlRowWriter) close() error {
+	return nil
+}
+
+// scanCSVRows matches columns by the header, columns it doesn't know are ignored.
+func scanCSVRows(r io.Reader, lenient bool, row func(row *datasetRow) error) (int, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("%w: header: %s", errParsingDatasetFailed, err)
+	}
+	positions := map[string]int{}
+	for i, name := range header {
+		positions[strings.TrimSpace(name)] = i
+	}
+
+	rejected := 0
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rejected, nil
+		}
+		var parseErr *csv.ParseError
+		if lenient && errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+			rejected++
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+		}
+
+		decoded, i, err := csvDatasetRow(record, positions)
+		if err != nil {
+			if _, loadErr := csvRow(record, positions); lenient && loadErr != nil {
+				rejected++
+				continue
+			}
+			line, _ := reader.FieldPos(i)
+			return 0, fmt.Errorf("%w: line %d: %s", errParsingDatasetFailed, line, err)
+		}
+		if err = row(&decoded); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// csvDatasetRow fills a row from the columns of record, i is the position of
+// the column that fails.
+func csvDatasetRow(record []string, positions map[string]int) (row datasetRow, i int, err error) {
+	for _, column := range datasetColumns {
+		i, ok := positions[column.name]
+		if !ok {
+			continue
+		}
+		if err = column.setText(&row, record[i]); err != nil {
+			return row, i, err
+		}
+	}
+	return row, 0, nil
+}
+
+type csvRowWriter struct {
+	enc     *csv.Writer
+	record  []string
+	started bool
+}
+
+func newCSVRowWriter(w io.Writer) datasetWriter {
+	return &csvRowWriter{enc: csv.NewWriter(w), record: make([]string, len(datasetColumns))}
+}
+
+func (c *csvRowWriter) start() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	for i, column := range datasetColumns {
+		c.record[i] = column.name
+	}
+	return c.enc.Write(c.record)
+}
+
+func (c *csvRowWriter) write(row *datasetRow) error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	for i, column := range datasetColumns {
+		c.record[i] = column.text(row)
+	}
+	return c.enc.Write(c.record)
+}
+
+func (c *csvRowWriter) close() error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	c.enc.Flush()
+	return c.enc.Error()
+}
+
+// columnarRowWriter collects the rows, a column can only be written once
+// every row is known.
+type columnarRowWriter struct {
+	w    io.Writer
+	rows []datasetRow
+}
+
+func newColumnarRowWriter(w io.Writer) datasetWriter {
+	return &columnarRowWriter{w: w}
+}
+
+func (c *columnarRowWriter) write(row *datasetRow) error {
+	c.rows = append(c.rows, *row)
+	return nil
+}
+
+func (c *columnarRowWriter) close() error {
+	return writeColumnarRows(c.w, c.rows)
+}
+
+// writeColumnarRows stores the rows column by column, so analytics tools can
+// read one field without the others. The layout is the magic, the row and
+// column counts, then for every column its name, its kind and its values:
+// ints as zigzag varints, bools as a bitmap, strings as all the lengths
+// followed by all the bytes. Counts and lengths are uvarints.
+func writeColumnarRows(w io.Writer, rows []datasetRow) error {
+	buf := bufio.NewWriter(w)
+	var scratch []byte
+	scratch = append(scratch, columnarMagic...)
+	scratch = binary.AppendUvarint(scratch, uint64(len(rows)))
+	scratch = binary.AppendUvarint(scratch, uint64(len(datasetColumns)))
+	for _, column := range datasetColumns {
+		scratch = binary.AppendUvarint(scratch, uint64(len(column.name)))
+		scratch = append(scratch, column.name...)
+		scratch = append(scratch, column.kind)
+
+		switch column.kind {
+		case columnInt:
+			for i := range rows {
+				scratch = binary.AppendVarint(scratch, reflect.ValueOf(&rows[i]).Elem().Field(column.index).Int())
+			}
+		case columnBool:
+			bitmap := make([]byte, (len(rows)+7)/8)
+			for i := range rows {
+				if reflect.ValueOf(&rows[i]).Elem().Field(column.index).Bool() {
+					bitmap[i/8] |= 1 << (i % 8)
+				}
+			}
+			scratch = append(scratch, bitmap...)
+		default:
+			for i := range rows {
+				scratch = binary.AppendUvarint(scratch, uint64(len(column.text(&rows[i]))))
+			}
+			for i := range rows {
+				scratch = append(scratch, column.text(&rows[i])...)
+			}
+		}
+		if _, err := buf.Write(scratch); err != nil {
+			return err
+		}
+		scratch = scratch[:0]
+	}
+	return buf.Flush()
+}
+
+// scanColumnarRows reads the output of writeColumnarRows. Columns it doesn't
+// know are skipped, so files written by a newer version still load. The
+// file holds a row's values apart, so all rows are read before the first is
+// handed over.
+func scanColumnarRows(r io.Reader, _ bool, row func(row *datasetRow) error) (int, error) {
+	rows, err := decodeColumnar(bufio.NewReader(r))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, fmt.Errorf("%w: %w: %w", errParsingDatasetFailed, errBadColumnarFile, err)
+	}
+	for i := range rows {
+		if err = row(&rows[i]); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func decodeColumnar(r *bufio.Reader) ([]datasetRow, error) {
+	magic := make([]byte, len(columnarMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, columnarMagic) {
+		return nil, errors.New("unknown magic or version")
+	}
+	rowCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	columnCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]datasetColumn{}
+	for _, column := range datasetColumns {
+		known[column.name] = column
+	}
+	if rowCount > maxColumnarValue {
+		return nil, fmt.Errorf("row count %d is too large", rowCount)
+	}
+	rows := make([]datasetRow, rowCount)
+	for c := uint64(0); c < columnCount; c++ {
+		name, err := readColumnarBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		column, ok := known[string(name)]
+		if ok && column.kind != kind {
+			return nil, fmt.Errorf("column %s has kind %q, want %q", name, kind, column.kind)
+		}
+
+		field := func(i int) reflect.Value {
+			return reflect.ValueOf(&rows[i]).Elem().Field(column.index)
+		}
+		switch kind {
+		case columnInt:
+			for i := range rows {
+				n, err := binary.ReadVarint(r)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					field(i).SetInt(n)
+				}
+			}
+		case columnBool:
+			bitmap, err := readColumnarN(r, uint64(len(rows)+7)/8)
+			if err != nil {
+				return nil, err
+			}
+			for i := range rows {
+				if ok {
+					field(i).SetBool(bitmap[i/8]&(1<<(i%8)) != 0)
+				}
+			}
+		case columnString:
+			lengths := make([]uint64, len(rows))
+			for i := range lengths {
+				if lengths[i], err = binary.ReadUvarint(r); err != nil {
+					return nil, err
+				}
+			}
+			for i, length := range lengths {
+				text, err := readColumnarN(r, length)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					field(i).SetString(string(text))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("column %s has unknown kind %q", name, kind)
+		}
+	}
+	return rows, nil
+}
+
+func readColumnarBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	return readColumnarN(r, length)
+}
+
+// readColumnarN reads n bytes without trusting n for the allocation, a
+// corrupt length must end in an error rather than a huge buffer.
+func readColumnarN(r io.Reader, n uint64) ([]byte, error) {
+	if n > maxColumnarValue {
+		return nil, fmt.Errorf("value of %d bytes is too long", n)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := io.CopyN(buf, r, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runConvert is the convert command. Formats follow the file extensions
+// unless -from or -to is given, an output of - is stdout. It returns the
+// exit code: 1 if the conversion failed, 2 on bad usage.
+func runConvert(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	formats := strings.Join(sortedKeys(datasetCodecs), ", ")
+	from := flags.String("from", sourceAuto, "input format: auto, "+formats)
+	to := flags.String("to", sourceAuto, "output format: auto, "+formats)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: search-server convert [-from format] [-to format] input output")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	input, output := flags.Arg(0), flags.Arg(1)
+
+	reader, err := codecFor(input, *from)
+	if err != nil {
+		fmt.Fprintf(stderr, "convert: %s\n", err)
+		return 2
+	}
+	writer, err := codecFor(output, *to)
+	if err != nil {
+		fmt.Fprintf(stderr, "convert: %s\n", err)
+		return 2
+	}
+
+	if err = convertDataset(input, output, reader, writer, stdout); err != nil {
+		fmt.Fprintf(stderr, "convert: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func convertDataset(input, output string, reader, writer datasetCodec, stdout io.Writer) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	convert := func(w io.Writer) error {
+		out := writer.newWriter(w)
+		if _, err := reader.scan(bufio.NewReaderSize(in, 64<<10), false, out.write); err != nil {
+			return err
+		}
+		return out.close()
+	}
+	if output == "-" {
+		return convert(stdout)
+	}
+	return writeFileAtomic(output, convert)
+}
+
+// writeFileAtomic writes path next to it and renames it into place once it's
+// synced, so a failure or a crash never leaves a truncated file behind.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0o644); err == nil {
+		err = write(tmp)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the creation or renaming of a file in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
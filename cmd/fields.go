@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"strings"
+)
+
+const (
+	firstNameFieldName = "first_name"
+	lastNameFieldName  = "last_name"
+	aboutFieldName     = "about"
+	genderFieldName    = "gender"
+	emailFieldName     = "email"
+	phoneFieldName     = "phone"
+	addressFieldName   = "address"
+)
+
+type userField struct {
+	Name       string
+	JSONKey    string
+	Sortable   bool
+	Searchable bool
+	// Collated fields are text sorted by the collation of the request locale, compare is unused for them
+	Collated bool
+	value    func(u UserClient) interface{}
+	compare  func(a, b UserClient) int
+}
+
+const (
+	firstNamePlaceholder = "{first}"
+	lastNamePlaceholder  = "{last}"
+)
+
+// namePattern composes the display name of a user from the first and last
+// name, see -name-pattern.
+var namePattern = firstNamePlaceholder + " " + lastNamePlaceholder
+
+var errBadNamePattern = errors.New("name pattern must contain {first} or {last}")
+
+func validateNamePattern(pattern string) error {
+	if !strings.Contains(pattern, firstNamePlaceholder) && !strings.Contains(pattern, lastNamePlaceholder) {
+		return errBadNamePattern
+	}
+	return nil
+}
+
+// composeName fills namePattern in. A missing part leaves no stray spaces
+// at the ends.
+func composeName(first, last string) string {
+	return strings.TrimSpace(strings.NewReplacer(firstNamePlaceholder, first, lastNamePlaceholder, last).Replace(namePattern))
+}
+
+// userFields lists the attributes of UserClient in the order they are serialized.
+var userFields = []*userField{
+	{
+		Name:     idFieldName,
+		JSONKey:  "ID",
+		Sortable: true,
+		value:    func(u UserClient) interface{} { return u.ID },
+		compare:  func(a, b UserClient) int { return cmp.Compare(a.ID, b.ID) },
+	},
+	{
+		Name:       nameFieldName,
+		JSONKey:    "Name",
+		Sortable:   true,
+		Searchable: true,
+		Collated:   true,
+		value:      func(u UserClient) interface{} { return u.Name },
+		compare:    func(a, b UserClient) int { return strings.Compare(a.Name, b.Name) },
+	},
+	{
+		Name:       firstNameFieldName,
+		JSONKey:    "FirstName",
+		Sortable:   true,
+		Searchable: true,
+		Collated:   true,
+		value:      func(u UserClient) interface{} { return u.FirstName },
+		compare:    func(a, b UserClient) int { return strings.Compare(a.FirstName, b.FirstName) },
+	},
+	{
+		Name:       lastNameFieldName,
+		JSONKey:    "LastName",
+		Sortable:   true,
+		Searchable: true,
+		Collated:   true,
+		value:      func(u UserClient) interface{} { return u.LastName },
+		compare:    func(a, b UserClient) int { return strings.Compare(a.LastName, b.LastName) },
+	},
+	{
+		Name:     ageFieldName,
+		JSONKey:  "Age",
+		Sortable: true,
+		value:    func(u UserClient) interface{} { return u.Age },
+		compare:  func(a, b UserClient) int { return cmp.Compare(a.Age, b.Age) },
+	},
+	{
+		Name:       aboutFieldName,
+		JSONKey:    "About",
+		Searchable: true,
+		value:      func(u UserClient) interface{} { return u.About },
+	},
+	{
+		Name:    genderFieldName,
+		JSONKey: "Gender",
+		value:   func(u UserClient) interface{} { return u.Gender },
+	},
+	{
+		Name:     emailFieldName,
+		JSONKey:  "Email",
+		Sortable: true,
+		value:    func(u UserClient) interface{} { return u.Email },
+		compare:  func(a, b UserClient) int { return strings.Compare(a.Email, b.Email) },
+	},
+	{
+		Name:    phoneFieldName,
+		JSONKey: "Phone",
+		value:   func(u UserClient) interface{} { return u.Phone },
+	},
+	{
+		Name:    addressFieldName,
+		JSONKey: "Address",
+		value:   func(u UserClient) interface{} { return u.Address },
+	},
+}
+
+func lookupUserField(name string) *userField {
+	for _, field := range userFields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	filterOpEq       = "eq"
+	filterOpNe       = "ne"
+	filterOpLt       = "lt"
+	filterOpLte      = "lte"
+	filterOpGt       = "gt"
+	filterOpGte      = "gte"
+	filterOpIn       = "in"
+	filterOpContains = "contains"
+
+	maxSearchBodySize = 1 << 20
+	maxFilters        = 32
+)
+
+var (
+	errBadRequestBody = errors.New("bad request body")
+	errBadFilters     = errors.New("bad filters")
+
+	intFilterOps    = []string{filterOpEq, filterOpNe, filterOpLt, filterOpLte, filterOpGt, filterOpGte, filterOpIn}
+	stringFilterOps = []string{filterOpEq, filterOpNe, filterOpLt, filterOpLte, filterOpGt, filterOpGte, filterOpIn, filterOpContains}
+)
+
+type SearchFilterServer struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// parseBodyParams decodes a POST search request. The body is checked against
+// searchBodySchema first, unknown keys are rejected so that typos don't
+// silently widen the search.
+func parseBodyParams(w http.ResponseWriter, r *http.Request) (*SearchRequestServer, error) {
+	if mediaType := r.Header.Get("Content-Type"); mediaType != "" && !strings.HasPrefix(mediaType, "application/json") {
+		return nil, errBadRequestBody
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSearchBodySize))
+	if err != nil {
+		return nil, errBadRequestBody
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var document interface{}
+	if err = dec.Decode(&document); err != nil {
+		return nil, errBadRequestBody
+	}
+	if dec.More() {
+		return nil, errBadRequestBody
+	}
+
+	var errs validationErrors
+	if searchBodySchema.validate("", document, &errs); len(errs) > 0 {
+		return nil, errs
+	}
+
+	dec = json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	params := &SearchRequestServer{Limit: defaultLimit, Offset: defaultOffset, OrderBy: defaultOrderBy}
+	if err = dec.Decode(params); err != nil {
+		return nil, errBadRequestBody
+	}
+
+	return params, nil
+}
+
+func validateFilters(filters []SearchFilterServer, view *fieldView, errs *validationErrors) {
+	if len(filters) > maxFilters {
+		errs.add(errBadFilters, "at most %d filters are allowed", maxFilters)
+		return
+	}
+	for _, filter := range filters {
+		if _, err := compileFilter(filter, view); err != nil {
+			*errs = append(*errs, err)
+		}
+	}
+}
+
+func applyFilters(users []UserClient, filters []SearchFilterServer, view *fieldView) []UserClient {
+	matchers := make([]func(UserClient) bool, 0, len(filters))
+	for _, filter := range filters {
+		match, err := compileFilter(filter, view)
+		if err != nil {
+			continue
+		}
+		matchers = append(matchers, match)
+	}
+
+	return slices.DeleteFunc(users, func(user UserClient) bool {
+		for _, match := range matchers {
+			if !match(user) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func compileFilter(filter SearchFilterServer, view *fieldView) (func(UserClient) bool, *paramError) {
+	field := lookupUserField(filter.Field)
+	if field == nil || !view.usable(field.Name) {
+		return nil, newParamError(errBadFilters, "unknown field %q", filter.Field)
+	}
+
+	_, isInt := field.value(UserClient{}).(int)
+	ops := stringFilterOps
+	if isInt {
+		ops = intFilterOps
+	}
+	if !slices.Contains(ops, filter.Op) {
+		return nil, newParamError(errBadFilters, "op %q is not allowed for field %q", filter.Op, filter.Field)
+	}
+
+	rawValues := []interface{}{filter.Value}
+	if filter.Op == filterOpIn {
+		list, ok := filter.Value.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, newParamError(errBadFilters, "op %q expects a non-empty list", filter.Op)
+		}
+		rawValues = list
+	}
+
+	values := make([]interface{}, 0, len(rawValues))
+	for _, raw := range rawValues {
+		value, ok := filterValue(raw, isInt)
+		if !ok {
+			return nil, newParamError(errBadFilters, "bad value for field %q", filter.Field)
+		}
+		values = append(values, value)
+	}
+
+	compare := func(user UserClient, value interface{}) int {
+		if isInt {
+			return cmp.Compare(field.value(user).(int), value.(int))
+		}
+		return strings.Compare(field.value(user).(string), value.(string))
+	}
+
+	return func(user UserClient) bool {
+		switch filter.Op {
+		case filterOpEq:
+			return compare(user, values[0]) == 0
+		case filterOpNe:
+			return compare(user, values[0]) != 0
+		case filterOpLt:
+			return compare(user, values[0]) < 0
+		case filterOpLte:
+			return compare(user, values[0]) <= 0
+		case filterOpGt:
+			return compare(user, values[0]) > 0
+		case filterOpGte:
+			return compare(user, values[0]) >= 0
+		case filterOpContains:
+			return strings.Contains(field.value(user).(string), values[0].(string))
+		default:
+			return slices.ContainsFunc(values, func(value interface{}) bool {
+				return compare(user, value) == 0
+			})
+		}
+	}, nil
+}
+
+func filterValue(raw interface{}, isInt bool) (interface{}, bool) {
+	if !isInt {
+		value, ok := raw.(string)
+		return value, ok
+	}
+
+	switch value := raw.(type) {
+	case json.Number:
+		n, err := value.Int64()
+		if err != nil || n > math.MaxInt32 || n < math.MinInt32 {
+			return nil, false
+		}
+		return int(n), true
+	case int:
+		return value, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatXML    = "xml"
+
+	streamBufferSize = 32 << 10
+)
+
+var (
+	errBadFormatParam = errors.New("bad format param")
+	errNotAcceptable  = errors.New("no acceptable response format")
+)
+
+// outputFormat is one representation of a search result. Every format
+// writes the fields in registry order, so columns line up across formats.
+type outputFormat struct {
+	name        string
+	contentType string
+	// mediaTypes are matched against the Accept header, the first one is canonical
+	mediaTypes []string
+	encode     func(w io.Writer, view *fieldView, users []UserClient) error
+}
+
+var outputFormats = []*outputFormat{
+	{
+		name:        formatJSON,
+		contentType: "application/json",
+		mediaTypes:  []string{"application/json"},
+		encode:      encodeJSONUsers,
+	},
+	{
+		name:        formatNDJSON,
+		contentType: "application/x-ndjson",
+		mediaTypes:  []string{"application/x-ndjson", "application/ndjson", "application/jsonl"},
+		encode:      encodeNDJSONUsers,
+	},
+	{
+		name:        formatCSV,
+		contentType: "text/csv; charset=utf-8",
+		mediaTypes:  []string{"text/csv"},
+		encode:      encodeCSVUsers,
+	},
+	{
+		name:        formatXML,
+		contentType: "application/xml; charset=utf-8",
+		mediaTypes:  []string{"application/xml", "text/xml"},
+		encode:      encodeXMLUsers,
+	},
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(outputFormats))
+	for _, format := range outputFormats {
+		names = append(names, format.name)
+	}
+	return names
+}
+
+func formatMediaTypes() []string {
+	mediaTypes := make([]string, 0, len(outputFormats))
+	for _, format := range outputFormats {
+		mediaTypes = append(mediaTypes, format.mediaTypes[0])
+	}
+	return mediaTypes
+}
+
+// negotiateFormat picks the output format. The format query parameter wins
+// over the Accept header, a bad value of it is reported along with the other
+// parameters. A request without either gets JSON.
+func negotiateFormat(r *http.Request, errs *validationErrors) (*outputFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, format := range outputFormats {
+			if format.name == name {
+				return format, nil
+			}
+		}
+		errs.add(errBadFormatParam, "unknown format %q", name)
+		return outputFormats[0], nil
+	}
+
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return outputFormats[0], nil
+	}
+	preferred, refused := parsePreferences(strings.Join(accept, ","))
+	if fallsBackToDefault(preferred, refused) {
+		return outputFormats[0], nil
+	}
+	for _, mediaRange := range preferred {
+		for _, format := range outputFormats {
+			if slices.ContainsFunc(format.mediaTypes, func(mediaType string) bool {
+				return mediaRangeMatches(mediaRange, mediaType) && (mediaRange == mediaType || !slices.Contains(refused, mediaType))
+			}) {
+				return format, nil
+			}
+		}
+	}
+	return nil, errNotAcceptable
+}
+
+// fallsBackToDefault tells a browser Accept header, such as
+// "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", from an
+// API client's: the first choice is nothing the server produces, */* takes
+// anything and no JSON type is named. XML there is a fallback for pages, not
+// a preference over JSON.
+func fallsBackToDefault(preferred, refused []string) bool {
+	if len(preferred) == 0 || !slices.Contains(preferred, "*/*") || slices.Contains(refused, outputFormats[0].mediaTypes[0]) {
+		return false
+	}
+	for _, format := range outputFormats {
+		if slices.ContainsFunc(format.mediaTypes, func(mediaType string) bool {
+			return mediaRangeMatches(preferred[0], mediaType)
+		}) {
+			return false
+		}
+	}
+	return !slices.ContainsFunc(preferred, func(mediaRange string) bool {
+		return strings.Contains(mediaRange, "json")
+	})
+}
+
+// parsePreferences returns the values of an Accept or Accept-Encoding header,
+// most preferred first. Values with q=0 or a malformed q are left out and
+// returned as refused: RFC 9110 excludes them even where a wildcard matches.
+func parsePreferences(header string) (preferred, refused []string) {
+	type weighted struct {
+		value string
+		q     float64
+	}
+
+	values := make([]weighted, 0)
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, rawQ, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(rawQ), 64); err != nil {
+				q = 0
+			}
+		}
+		if q > 0 {
+			values = append(values, weighted{value: value, q: q})
+		} else {
+			refused = append(refused, value)
+		}
+	}
+
+	slices.SortStableFunc(values, func(a, b weighted) int {
+		return cmp.Compare(b.q, a.q)
+	})
+	preferred = make([]string, 0, len(values))
+	for _, item := range values {
+		preferred = append(preferred, item.value)
+	}
+	return preferred, refused
+}
+
+func mediaRangeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	rangeType, rangeSubtype, _ := strings.Cut(mediaRange, "/")
+	typ, _, _ := strings.Cut(mediaType, "/")
+	return rangeSubtype == "*" && rangeType == typ
+}
+
+// sendUsers streams users in the given format. Rows are encoded straight into
+// a buffered writer over the response, so large pages are never held in memory
+// twice. Once the header is out a failure can only cut the response short.
+func sendUsers(w http.ResponseWriter, r *http.Request, format *outputFormat, view *fieldView, users []UserClient) {
+	noteResultSize(w, len(users))
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+
+	buf := bufio.NewWriterSize(w, streamBufferSize)
+	err := format.encode(buf, view, users)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Warn("sendUsers: Failed to send response", slog.String("format", format.name), slog.String("error", err.Error()))
+	}
+}
+
+func encodeJSONUsers(w io.Writer, view *fieldView, users []UserClient) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, user := range users {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := writeUserJSON(w, view, user); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+func encodeNDJSONUsers(w io.Writer, view *fieldView, users []UserClient) error {
+	for _, user := range users {
+		if err := writeUserJSON(w, view, user); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeUserJSON(w io.Writer, view *fieldView, user UserClient) error {
+	row, err := userView{user: user, view: view}.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(row)
+	return err
+}
+
+// encodeCSVUsers writes a header row with the field names followed by one row per user.
+func encodeCSVUsers(w io.Writer, view *fieldView, users []UserClient) error {
+	enc := csv.NewWriter(w)
+	record := make([]string, len(view.fields))
+	for i, field := range view.fields {
+		record[i] = field.Name
+	}
+	if err := enc.Write(record); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		for i, field := range view.fields {
+			record[i] = view.textValue(field, user)
+		}
+		if err := enc.Write(record); err != nil {
+			return err
+		}
+	}
+	enc.Flush()
+	return enc.Error()
+}
+
+// encodeXMLUsers writes the rows in the schema of dataset.xml, so the output
+// can be loaded back as a dataset as long as first_name and last_name are in it.
+func encodeXMLUsers(w io.Writer, view *fieldView, users []UserClient) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	root := xml.StartElement{Name: xml.Name{Local: "root"}}
+	row := xml.StartElement{Name: xml.Name{Local: "row"}}
+	if err := enc.EncodeToken(root); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := enc.EncodeToken(row); err != nil {
+			return err
+		}
+		for _, field := range view.fields {
+			if err := enc.EncodeElement(view.textValue(field, user), xml.StartElement{Name: xml.Name{Local: field.Name}}); err != nil {
+				return err
+			}
+		}
+		if err := enc.EncodeToken(row.End()); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// textValue is the field as it appears in the text formats, redaction applied.
+func (v *fieldView) textValue(field *userField, user UserClient) string {
+	if v.redacted[field.Name] {
+		return redactedValue
+	}
+	return fmt.Sprint(field.value(user))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var errBadLogConfig = errors.New("bad log config")
+
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("%w: unknown level %q", errBadLogConfig, level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", errBadLogConfig, format)
+	}
+}
+
+// loggerFromContext returns the default logger annotated with the request ID, if any.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if id := requestInfoFromContext(ctx).id(); id != "" {
+		return slog.Default().With(slog.String("request_id", id))
+	}
+	return slog.Default()
+}
+
+// withRequestID takes the request ID from X-Request-ID or generates a new one,
+// echoes it back and starts the per-request annotations used by other middleware.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{requestID: id}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoCtxKey, info)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r < '!' || r > '~'
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		info := requestInfoFromContext(r.Context())
+		info.mu.Lock()
+		attrs := []slog.Attr{
+			slog.String("request_id", info.requestID),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", info.route),
+			slog.Int("status", rec.status()),
+			slog.Int("bytes", rec.written),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if span := spanFromContext(r.Context()); span != nil {
+			attrs = append(attrs, slog.String("trace_id", span.SpanContext().TraceID.String()))
+		}
+		if info.subject != "" {
+			attrs = append(attrs, slog.String("subject", info.subject))
+		}
+		if len(info.params) > 0 {
+			attrs = append(attrs, slog.Any("params", info.params))
+		}
+		if info.authFailure != "" {
+			attrs = append(attrs, slog.String("auth_failure", info.authFailure))
+		}
+		info.mu.Unlock()
+		if stats := responseStatsOf(w); stats != nil {
+			if len(stats.invalidParams) > 0 {
+				attrs = append(attrs, slog.Any("invalid_params", stats.invalidParams))
+			}
+			if stats.hasResult {
+				attrs = append(attrs, slog.Int("result_count", stats.resultSize))
+			}
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status() >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case rec.status() >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+		case "convert":
+			os.Exit(runConvert(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	addr := flag.String("addr", ":8080", "address to listen on")
+	flag.StringVar(&database, "dataset", database, "path to the dataset")
+	flag.StringVar(&datasetFormat, "dataset-format", datasetFormat, "dataset format: "+strings.Join(sourceFormats(), ", "))
+	flag.StringVar(&datasetLoadMode, "dataset-mode", datasetLoadMode, "dataset load mode: strict fails on a malformed row, lenient skips and reports it")
+	policyPath := flag.String("access-policy", "", "path to the JSON field access policy")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", logFormatText, "log format: text or json")
+	traceLog := flag.Bool("trace-log", false, "export trace spans to the log at debug level")
+	flag.IntVar(&defaultLimit, "default-limit", defaultLimit, "page size for search requests without limit")
+	flag.IntVar(&compressMinSize, "compress-min-size", compressMinSize, "compress responses of at least this many bytes, negative to disable")
+	flag.StringVar(&namePattern, "name-pattern", namePattern, "display name of a user, {first} and {last} are replaced with the name parts")
+	flag.StringVar(&defaultLocale, "locale", defaultLocale, "BCP 47 language tag whose collation sorts names when the request has no locale")
+	flag.StringVar(&mutationLog, "mutation-log", mutationLog, "write-ahead log the write API persists changes to, writes are disabled without it")
+	flag.DurationVar(&compactInterval, "compact-interval", compactInterval, "how often the mutation log is folded into the dataset, 0 to disable")
+	flag.DurationVar(&reloadInterval, "reload-interval", reloadInterval, "how often the dataset file is checked for changes")
+	flag.BoolVar(&strictParams, "strict-params", strictParams, "reject unknown search query parameters instead of ignoring them")
+	flag.Parse()
+
+	if defaultLimit <= 0 {
+		slog.Error("main: -default-limit must be greater than 0", slog.Int("default_limit", defaultLimit))
+		os.Exit(1)
+	}
+
+	if err := validateNamePattern(namePattern); err != nil {
+		slog.Error("main: Bad -name-pattern", slog.String("name_pattern", namePattern), slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if _, err := language.Parse(defaultLocale); err != nil {
+		slog.Error("main: Bad -locale", slog.String("locale", defaultLocale), slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if compactInterval < 0 {
+		slog.Error("main: -compact-interval must not be negative", slog.Duration("compact_interval", compactInterval))
+		os.Exit(1)
+	}
+	if datasetLoadMode != loadModeStrict && datasetLoadMode != loadModeLenient {
+		slog.Error("main: -dataset-mode must be strict or lenient", slog.String("dataset_mode", datasetLoadMode))
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		slog.Error("main: Failed to configure logging", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	if *traceLog {
+		tracer = newTracer(LogExporter{})
+	}
+
+	if *policyPath != "" {
+		policy, err := loadAccessPolicy(*policyPath)
+		if err != nil {
+			slog.Error("main: Failed to load access policy", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		accessPolicy = policy
+	}
+
+	// the server listens while the dataset loads, so liveness, readiness and
+	// the load progress in /v1/status can be watched during a long first load
+	loaded := store.loadInBackground(database)
+	go func() {
+		if err := <-loaded; err != nil {
+			slog.Warn("main: Dataset is not loaded, the server is not ready", slog.String("path", database), slog.String("error", err.Error()))
+		}
+		// the load replayed the mutation log and dropped a record a crash tore
+		if mutationLog != "" && compactInterval > 0 {
+			compactPeriodically(compactInterval)
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           NewRouter(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	slog.Info("main: Listening", slog.String("addr", *addr))
+	if err = srv.ListenAndServe(); err != nil {
+		slog.Error("main: Server stopped", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "search_server"
+
+var metrics = newServerMetrics()
+
+type serverMetrics struct {
+	requests         *counterVec
+	latency          *histogramVec
+	validationErrors *counterVec
+	authFailures     *counterVec
+	resultSize       *histogramVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests: newCounterVec("requests_total",
+			"Requests handled, by route, method and status code.", "route", "method", "code"),
+		latency: newHistogramVec("request_duration_seconds",
+			"Request latency in seconds, by route.",
+			[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}, "route"),
+		validationErrors: newCounterVec("validation_errors_total",
+			"Rejected request parameters, by parameter.", "param"),
+		authFailures: newCounterVec("auth_failures_total",
+			"Rejected AccessTokens, by reason.", "reason"),
+		resultSize: newHistogramVec("result_size",
+			"Users returned per response, by route.",
+			[]float64{0, 1, 5, 10, 25, 50, 100}, "route"),
+	}
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	m.requests.write(w)
+	m.latency.write(w)
+	m.validationErrors.write(w)
+	m.authFailures.write(w)
+	m.resultSize.write(w)
+
+	status := store.status()
+	writeGauge(w, "dataset_users", "Users in the dataset currently in service.", float64(status.Users))
+	writeGauge(w, "dataset_ready", "Whether a dataset has been loaded successfully.", boolToFloat(status.Ready))
+	writeGauge(w, "dataset_rejected_rows", "Malformed rows the dataset in service was loaded without.", float64(status.RejectedRows))
+	writeCounter(w, "dataset_reloads_total", "Successful dataset loads.", float64(status.Reloads))
+	writeCounter(w, "dataset_reload_failures_total", "Failed dataset loads.", float64(status.ReloadFailures))
+}
+
+// withRoute labels the request with the mux pattern that matched it.
+func withRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestInfoFromContext(r.Context()).setRoute(pattern)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		stats := &responseStats{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(stats, r)
+
+		info := requestInfoFromContext(r.Context())
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		route := info.route
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.requests.inc(route, r.Method, strconv.Itoa(stats.status()))
+		metrics.latency.observe(time.Since(start).Seconds(), route)
+		for _, param := range stats.invalidParams {
+			metrics.validationErrors.inc(param)
+		}
+		if info.authFailure != "" {
+			metrics.authFailures.inc(info.authFailure)
+		}
+		if stats.hasResult {
+			metrics.resultSize.observe(float64(stats.resultSize), route)
+		}
+	})
+}
+
+// responseStats is the ResponseWriter withMetrics serves with. The helpers
+// that write responses note what the body carries on it: how many users and,
+// for a 400 problem, which parameters were rejected.
+type responseStats struct {
+	statusRecorder
+	invalidParams []string
+	resultSize    int
+	hasResult     bool
+}
+
+// resultSizer is implemented by response bodies that carry users.
+type resultSizer interface {
+	resultSize() int
+}
+
+// responseStatsOf finds the responseStats w writes through, nil without one.
+func responseStatsOf(w http.ResponseWriter) *responseStats {
+	for {
+		switch rw := w.(type) {
+		case *responseStats:
+			return rw
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+func noteResultSize(w http.ResponseWriter, n int) {
+	if stats := responseStatsOf(w); stats != nil {
+		stats.resultSize, stats.hasResult = n, true
+	}
+}
+
+// noteProblem records the parameters a 400 problem rejected.
+func noteProblem(w http.ResponseWriter, problem ErrorServer) {
+	stats := responseStatsOf(w)
+	if stats == nil || problem.Status != http.StatusBadRequest {
+		return
+	}
+	for _, invalid := range problem.InvalidParams {
+		stats.invalidParams = append(stats.invalidParams, invalid.Name)
+	}
+	if len(problem.InvalidParams) == 0 {
+		param := problem.Param
+		if param == "" {
+			param = "unknown"
+		}
+		stats.invalidParams = append(stats.invalidParams, param)
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   metricsNamespace + "_" + name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    metricsNamespace + "_" + name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			le := `le="` + formatFloat(bound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="+Inf"`), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), series.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	name = metricsNamespace + "_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	name = metricsNamespace + "_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func formatLabels(names []string, key string, extra string) string {
+	pairs := make([]string, 0, len(names)+1)
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+type middleware func(http.Handler) http.Handler
+
+type ctxKey int
+
+const (
+	viewCtxKey ctxKey = iota
+	principalCtxKey
+	requestInfoCtxKey
+)
+
+// chain wraps h so that the first middleware in the list is the outermost one.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// requireAuth checks the access token for the given scope and puts the caller
+// and its field view into the request context.
+func requireAuth(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracer.Start(r.Context(), "auth")
+		caller, err := authCheck(accessToken(r), scope)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			var authErr *authError
+			if errors.As(err, &authErr) {
+				requestInfoFromContext(r.Context()).setAuthFailure(authErr.Reason)
+			}
+			sendAuthError(w, r, err)
+			return
+		}
+
+		requestInfoFromContext(r.Context()).setSubject(caller.Subject)
+		ctx := context.WithValue(r.Context(), principalCtxKey, caller)
+		ctx = context.WithValue(ctx, viewCtxKey, accessPolicy.viewFor(caller))
+		next(w, r.WithContext(ctx))
+	})
+}
+
+func viewFromContext(ctx context.Context) *fieldView {
+	if view, ok := ctx.Value(viewCtxKey).(*fieldView); ok {
+		return view
+	}
+	return accessPolicy.viewFor(nil)
+}
+
+func principalFromContext(ctx context.Context) *principal {
+	caller, _ := ctx.Value(principalCtxKey).(*principal)
+	return caller
+}
+
+// requestInfo is filled in by handlers and middleware while a request is served
+// and recorded by withMetrics and withLogging once it's done.
+type requestInfo struct {
+	mu          sync.Mutex
+	requestID   string
+	route       string
+	subject     string
+	params      map[string]interface{}
+	authFailure string
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoCtxKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+func (info *requestInfo) setRoute(route string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.route = route
+}
+
+func (info *requestInfo) setAuthFailure(reason string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.authFailure = reason
+}
+
+func (info *requestInfo) routeName() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.route
+}
+
+func (info *requestInfo) id() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.requestID
+}
+
+func (info *requestInfo) setSubject(subject string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.subject = subject
+}
+
+func (info *requestInfo) setParams(params map[string]interface{}) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.params = params
+}
+
+// withRecovery turns a panic into a JSON 500. If the handler has already started
+// the response, the connection is aborted instead so the client doesn't take
+// a truncated body for a complete one.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler { //nolint:errorlint
+				panic(err)
+			}
+
+			loggerFromContext(r.Context()).Error("withRecovery: panic",
+				slog.Any("panic", err),
+				slog.String("path", r.URL.Path),
+				slog.String("stack", string(debug.Stack())),
+			)
+			if rec.statusCode != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			sendProblem(rec, r, errInternal)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// statusRecorder remembers the status code and the amount of bytes written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	written    int
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	if rec.statusCode == 0 {
+		rec.statusCode = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.written += n
+	return n, err
+}
+
+func (rec *statusRecorder) status() int {
+	if rec.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rec.statusCode
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	mutationPut    = "put"
+	mutationDelete = "delete"
+)
+
+var (
+	// mutationLog is the write-ahead log writes are persisted to, see
+	// -mutation-log. Every load replays it on top of the dataset, the dataset
+	// itself is only rewritten by compaction. Writes are disabled while it is empty.
+	mutationLog = ""
+	// compactInterval is how often the log is folded into the dataset, see
+	// -compact-interval. Zero disables compaction.
+	compactInterval = 10 * time.Minute
+)
+
+var errBadMutation = errors.New("bad mutation")
+
+// mutation is one change of the dataset. put carries the whole row, so
+// replaying a log gives the same result however often it is replayed.
+type mutation struct {
+	Op   string      `json:"op"`
+	ID   int         `json:"id"`
+	User *UserServer `json:"user,omitempty"`
+}
+
+func (m mutation) validate() error {
+	switch {
+	case m.Op == mutationPut && m.User != nil && m.User.ID == m.ID:
+		return nil
+	case m.Op == mutationDelete && m.User == nil:
+		return nil
+	}
+	return fmt.Errorf("%w: %q of user %d", errBadMutation, m.Op, m.ID)
+}
+
+// toUserServer turns a served user back into a dataset row.
+func (user UserClient) toUserServer() UserServer {
+	return UserServer{
+		ID:      user.ID,
+		Name:    user.FirstName,
+		Surname: user.LastName,
+		Age:     user.Age,
+		About:   user.About,
+		Gender:  user.Gender,
+		Email:   user.Email,
+		Phone:   user.Phone,
+		Address: user.Address,
+	}
+}
+
+// A record of the mutation log is one line: the CRC-32C of the JSON mutation
+// as 8 hex digits, a space and the mutation itself. The checksum tells a record
+// that is complete from one a crash cut short.
+const mutationHeaderSize = 9
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeMutation(m mutation) ([]byte, error) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 0, mutationHeaderSize+len(payload)+1)
+	record = fmt.Appendf(record, "%08x ", crc32.Checksum(payload, crcTable))
+	record = append(record, payload...)
+	return append(record, '\n'), nil
+}
+
+// decodeMutation parses a record without its newline.
+func decodeMutation(record []byte) (mutation, error) {
+	m := mutation{}
+	if len(record) < mutationHeaderSize || record[mutationHeaderSize-1] != ' ' {
+		return m, fmt.Errorf("%w: record is too short", errBadMutation)
+	}
+	sum, err := strconv.ParseUint(string(record[:mutationHeaderSize-1]), 16, 32)
+	if err != nil {
+		return m, fmt.Errorf("%w: bad checksum %q", errBadMutation, record[:mutationHeaderSize-1])
+	}
+	payload := record[mutationHeaderSize:]
+	if crc32.Checksum(payload, crcTable) != uint32(sum) {
+		return m, fmt.Errorf("%w: checksum mismatch", errBadMutation)
+	}
+	if err = json.Unmarshal(payload, &m); err != nil {
+		return m, err
+	}
+	return m, m.validate()
+}
+
+// appendMutation writes m to the log at path and syncs it to disk before it
+// returns, so an acknowledged write survives a crash. A write that fails
+// halfway is cut off again, later records must not follow a broken one.
+func appendMutation(path string, m mutation) error {
+	record, err := encodeMutation(m)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Write(record); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(info.Size()) //nolint:errcheck
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// a new log must survive a crash too, so its directory entry is synced as well
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// readMutations reads the log at path. valid is the size of its intact part:
+// only the last record may be broken, that's a write a crash cut short and it
+// was never acknowledged. A broken record followed by others is an error.
+func readMutations(path string) (mutations []mutation, valid int64, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	var broken error
+	brokenLine := 0
+	for line := 1; ; line++ {
+		record, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(record) == 0 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, err
+		}
+		if broken != nil {
+			return nil, 0, fmt.Errorf("%w: mutation log %s: line %d: %s", errParsingDatasetFailed, path, brokenLine, broken)
+		}
+
+		var m mutation
+		if err != nil {
+			// the newline is written last, a record without it is torn
+			broken = fmt.Errorf("%w: record is not terminated", errBadMutation)
+		} else {
+			m, broken = decodeMutation(record[:len(record)-1])
+		}
+		if broken != nil {
+			brokenLine = line
+			continue
+		}
+		mutations = append(mutations, m)
+		valid += int64(len(record))
+	}
+	return mutations, valid, nil
+}
+
+// replayMutations applies the log at path to a freshly read dataset. A
+// missing log means nothing was written yet. A torn record at the end is
+// dropped from the file, so new records don't follow it.
+func replayMutations(path string, loader *datasetLoader) error {
+	mutations, valid, err := readMutations(path)
+	if err != nil {
+		if !errors.Is(err, errParsingDatasetFailed) {
+			err = fmt.Errorf("mutation log %s: %w", path, err)
+		}
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > valid {
+		slog.Warn("replayMutations: Dropping a torn record at the end of the mutation log",
+			slog.String("path", path), slog.Int64("offset", valid), slog.Int64("bytes", info.Size()-valid))
+		if err = truncateFile(path, valid); err != nil {
+			return fmt.Errorf("mutation log %s: %w", path, err)
+		}
+	}
+
+	for _, m := range mutations {
+		loader.apply(m)
+	}
+	return nil
+}
+
+// compactMutations folds the log into the dataset at path and empties the
+// log, so it stops growing and loads don't replay it over and over. A crash
+// between the two steps is harmless: replaying the log on top of the
+// compacted dataset gives the same users again.
+func compactMutations(path, format, logPath string, lenient bool) (int, error) {
+	mutations, _, err := readMutations(logPath)
+	if err != nil || len(mutations) == 0 {
+		return 0, err
+	}
+	format, _, err = sourceFor(path, format)
+	if err != nil {
+		return 0, err
+	}
+	compact, ok := datasetCompactors[format]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s datasets can't be compacted", errUnknownSourceFormat, format)
+	}
+
+	if err = compact(path, mutations, lenient); err != nil {
+		return 0, err
+	}
+	return len(mutations), truncateFile(logPath, 0)
+}
+
+// datasetCompactor folds mutations into the dataset at path. With lenient,
+// the dataset is read the way a lenient load reads it.
+type datasetCompactor func(path string, mutations []mutation, lenient bool) error
+
+// datasetCompactors has a compactor for every format the server loads, and
+// so accepts writes to. SQLite registers itself when the server is built with
+// the sqlite tag.
+var datasetCompactors = map[string]datasetCompactor{
+	sourceXML:   rewriteDataset(datasetCodecs[convertXML]),
+	sourceJSON:  rewriteDataset(datasetCodecs[convertJSON]),
+	sourceJSONL: rewriteDataset(datasetCodecs[convertJSONL]),
+	sourceCSV:   rewriteDataset(datasetCodecs[convertCSV]),
+}
+
+// rewriteDataset compacts a dataset file by rewriting it in its own format,
+// with every element of its rows kept. Rows stream from the file through the
+// log into the new file, only the log is held in memory. The rows a lenient
+// load rejected are left out, they aren't served and may clash with IDs
+// given out since; the file as it was is kept next to the dataset, so they
+// can be fixed and added back.
+func rewriteDataset(codec datasetCodec) datasetCompactor {
+	return func(path string, mutations []mutation, lenient bool) error {
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		byID := map[int][]int{}
+		for i, m := range mutations {
+			byID[m.ID] = append(byID[m.ID], i)
+		}
+		return writeFileAtomic(path, func(w io.Writer) error {
+			out := codec.newWriter(w)
+			var appended []appendedRow
+			var writeErr error
+			rejected, err := codec.scan(bufio.NewReaderSize(in, 64<<10), lenient, func(row *datasetRow) error {
+				indexes, ok := byID[row.ID]
+				if !ok {
+					writeErr = out.write(row)
+					return writeErr
+				}
+				delete(byID, row.ID)
+				kept, created := foldMutations(row, mutations, indexes)
+				if created.row != nil {
+					appended = append(appended, created)
+				}
+				if kept {
+					writeErr = out.write(row)
+				}
+				return writeErr
+			})
+			if err != nil && writeErr == nil && !errors.Is(err, errParsingDatasetFailed) {
+				err = fmt.Errorf("%w: %w", errParsingDatasetFailed, err)
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, indexes := range byID {
+				if _, created := foldMutations(nil, mutations, indexes); created.row != nil {
+					appended = append(appended, created)
+				}
+			}
+			slices.SortFunc(appended, func(a, b appendedRow) int { return a.at - b.at })
+			for _, created := range appended {
+				if err = out.write(created.row); err != nil {
+					return err
+				}
+			}
+
+			if rejected > 0 {
+				orig, err := keepDataset(path)
+				if err != nil {
+					return err
+				}
+				slog.Warn("compactMutations: Leaving out rows a lenient load rejected",
+					slog.String("path", path), slog.Int("rows", rejected), slog.String("kept", orig))
+			}
+			return out.close()
+		})
+	}
+}
+
+// appendedRow is a row a put adds at the end of the dataset, at is the index
+// of the put in the log, which orders the appended rows.
+type appendedRow struct {
+	row *datasetRow
+	at  int
+}
+
+// foldMutations applies the mutations at indexes, all of one user, to its
+// row, nil if the dataset has none. It tells whether row stays in place and
+// returns the row a put appends once the user is gone, the way apply does.
+func foldMutations(row *datasetRow, mutations []mutation, indexes []int) (kept bool, created appendedRow) {
+	kept = row != nil
+	for _, i := range indexes {
+		m := mutations[i]
+		switch {
+		case m.Op == mutationDelete && created.row != nil:
+			created = appendedRow{}
+		case m.Op == mutationDelete:
+			kept = false
+		case kept:
+			row.setUser(*m.User)
+		case created.row != nil:
+			created.row.setUser(*m.User)
+		default:
+			created = appendedRow{row: &datasetRow{}, at: i}
+			created.row.setUser(*m.User)
+		}
+	}
+	return kept, created
+}
+
+// keepDataset copies the dataset at path to a file named after its hash, so
+// compacting the same version twice doesn't make a second copy.
+func keepDataset(path string) (string, error) {
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	kept := path + "." + hash[:12] + ".orig"
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	return kept, writeFileAtomic(kept, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+func (row *datasetRow) setUser(user UserServer) {
+	row.ID = user.ID
+	row.FirstName = user.Name
+	row.LastName = user.Surname
+	row.Age = user.Age
+	row.About = user.About
+	row.Gender = user.Gender
+	row.Email = user.Email
+	row.Phone = user.Phone
+	row.Address = user.Address
+}
+
+// truncateFile cuts the file at path to size and syncs it.
+func truncateFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// apply changes the users read so far. Deleted users leave a hole in users
+// that snapshot closes.
+func (l *datasetLoader) apply(m mutation) {
+	idx, found := l.byID[m.ID]
+	switch {
+	case m.Op == mutationDelete && found:
+		delete(l.byID, m.ID)
+		l.removed = true
+	case m.Op == mutationPut && found:
+		l.users[idx] = m.User.toUserClient()
+	case m.Op == mutationPut:
+		l.byID[m.ID] = len(l.users)
+		l.users = append(l.users, m.User.toUserClient())
+	}
+}
+
+// with returns the snapshot with m applied, the snapshot itself stays as it
+// is for the requests still reading it. Only the overlay of changed users is
+// copied, never the users that were loaded.
+func (s *usersSnapshot) with(m mutation) *usersSnapshot {
+	_, found := s.user(m.ID)
+	if m.Op == mutationDelete && !found {
+		return s
+	}
+
+	next := *s
+	next.changed = make(map[int]userChange, len(s.changed)+1)
+	for id, change := range s.changed {
+		next.changed[id] = change
+	}
+	change, changed := s.changed[m.ID]
+	if !changed {
+		change.created = -1
+	}
+	switch {
+	case m.Op == mutationDelete:
+		change.user = nil
+		next.count--
+	case found:
+		user := m.User.toUserClient()
+		change.user = &user
+	default:
+		// a created user, or one that was deleted, goes to the end like a replay puts it
+		user := m.User.toUserClient()
+		change.user, change.created = &user, len(s.created)
+		next.created = append(slices.Clip(s.created), m.ID)
+		next.count++
+		next.next = max(next.next, m.ID+1)
+	}
+	next.changed[m.ID] = change
+	return &next
+}
+
+// nextID is the ID a created user gets when the request doesn't pick one: one
+// more than the highest ID loaded or created since.
+func (s *usersSnapshot) nextID() int {
+	return s.next
+}
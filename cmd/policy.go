@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+)
+
+const (
+	scopePII = "pii"
+
+	fieldActionOmit   = "omit"
+	fieldActionRedact = "redact"
+
+	redactedValue = "[REDACTED]"
+)
+
+var (
+	accessPolicy = defaultAccessPolicy()
+
+	errBadAccessPolicy = errors.New("bad access policy")
+)
+
+// AccessPolicy declares which scope a caller needs to see a field and what
+// happens to the field when the scope is missing. Fields without a rule are public.
+type AccessPolicy struct {
+	Fields map[string]FieldRule `json:"fields"`
+}
+
+type FieldRule struct {
+	Scope  string `json:"scope"`
+	Action string `json:"action"`
+}
+
+// defaultAccessPolicy mirrors the shipped access_policy.json.
+func defaultAccessPolicy() *AccessPolicy {
+	return &AccessPolicy{
+		Fields: map[string]FieldRule{
+			emailFieldName:   {Scope: scopePII, Action: fieldActionRedact},
+			phoneFieldName:   {Scope: scopePII, Action: fieldActionOmit},
+			addressFieldName: {Scope: scopePII, Action: fieldActionOmit},
+		},
+	}
+}
+
+func loadAccessPolicy(path string) (*AccessPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	policy := &AccessPolicy{}
+	if err = dec.Decode(policy); err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadAccessPolicy, err)
+	}
+	if err = policy.validate(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (p *AccessPolicy) validate() error {
+	for name, rule := range p.Fields {
+		if lookupUserField(name) == nil {
+			return fmt.Errorf("%w: unknown field %q", errBadAccessPolicy, name)
+		}
+		if rule.Scope == "" {
+			return fmt.Errorf("%w: empty scope for field %q", errBadAccessPolicy, name)
+		}
+		if rule.Action != fieldActionOmit && rule.Action != fieldActionRedact {
+			return fmt.Errorf("%w: unknown action %q for field %q", errBadAccessPolicy, rule.Action, name)
+		}
+	}
+	return nil
+}
+
+// viewFor resolves the policy against the scopes of the caller.
+func (p *AccessPolicy) viewFor(caller *principal) *fieldView {
+	view := &fieldView{
+		fields:     make([]*userField, 0, len(userFields)),
+		restricted: make(map[string]bool),
+		redacted:   make(map[string]bool),
+	}
+
+	for _, field := range userFields {
+		rule, ok := p.Fields[field.Name]
+		if !ok || caller.hasScope(rule.Scope) {
+			view.fields = append(view.fields, field)
+			continue
+		}
+
+		view.restricted[field.Name] = true
+		if rule.Action == fieldActionRedact {
+			view.redacted[field.Name] = true
+			view.fields = append(view.fields, field)
+		}
+	}
+
+	return view
+}
+
+// fieldView is the set of fields a particular caller may read. Restricted fields
+// are either omitted or redacted in the output and can't be searched or sorted by.
+type fieldView struct {
+	fields     []*userField
+	restricted map[string]bool
+	redacted   map[string]bool
+}
+
+func (v *fieldView) usable(name string) bool {
+	return lookupUserField(name) != nil && !v.restricted[name]
+}
+
+// readable reports whether the field shows up in the output, possibly redacted.
+func (v *fieldView) readable(name string) bool {
+	return slices.ContainsFunc(v.fields, func(field *userField) bool {
+		return field.Name == name
+	})
+}
+
+// names lists the fields matching keep in the serialization order.
+func (v *fieldView) names(keep func(field *userField) bool) []string {
+	names := make([]string, 0, len(userFields))
+	for _, field := range userFields {
+		if keep(field) {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// selected narrows the view down to the requested fields, keeping the serialization order.
+func (v *fieldView) selected(names []string) *fieldView {
+	return &fieldView{
+		fields: slices.DeleteFunc(slices.Clone(v.fields), func(field *userField) bool {
+			return !slices.Contains(names, field.Name)
+		}),
+		restricted: v.restricted,
+		redacted:   v.redacted,
+	}
+}
+
+func (v *fieldView) project(users []UserClient) []userView {
+	projected := make([]userView, 0, len(users))
+	for _, user := range users {
+		projected = append(projected, userView{user: user, view: v})
+	}
+	return projected
+}
+
+type userView struct {
+	user UserClient
+	view *fieldView
+}
+
+func (u userView) resultSize() int { return 1 }
+
+func (u userView) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, field := range u.view.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		var value interface{} = redactedValue
+		if !u.view.redacted[field.Name] {
+			value = field.value(u.user)
+		}
+
+		rawValue, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(strconv.Quote(field.JSONKey))
+		buf.WriteByte(':')
+		buf.Write(rawValue)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
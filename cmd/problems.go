@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:search-server:problem:"
+
+	codeBadQueryParams    = "bad_query_params"
+	codeUnknownParam      = "unknown_param"
+	codeBadFormat         = "bad_format"
+	codeNotAcceptable     = "not_acceptable"
+	codeBadRequestBody    = "bad_request_body"
+	codeBadLimit          = "bad_limit"
+	codeBadOffset         = "bad_offset"
+	codeBadOrderBy        = "bad_order_by"
+	codeBadOrderField     = "bad_order_field"
+	codeBadFields         = "bad_fields"
+	codeBadFilters        = "bad_filters"
+	codeBadLocale         = "bad_locale"
+	codeBadID             = "bad_id"
+	codeBadIDs            = "bad_ids"
+	codeUserNotFound      = "user_not_found"
+	codeBadUser           = "bad_user"
+	codeUserExists        = "user_exists"
+	codeIfMatchRequired   = "if_match_required"
+	codeIfMatchFailed     = "if_match_failed"
+	codeWritesDisabled    = "writes_disabled"
+	codeInvalidToken      = "invalid_token"
+	codeInsufficientScope = "insufficient_scope"
+
+	codeInternal           = "internal_error"
+	codeDatasetUnavailable = "dataset_unavailable"
+	codeDatasetLoading     = "dataset_loading"
+	codeDatasetInvalid     = "dataset_invalid"
+)
+
+// problemType describes one kind of error answer, see RFC 7807.
+type problemType struct {
+	err     error
+	code    string
+	title   string
+	status  int
+	param   string
+	allowed func(view *fieldView) []string
+}
+
+var problemTypes = []problemType{
+	{err: errBadQueryParams, code: codeBadQueryParams, title: "Malformed query parameters", status: http.StatusBadRequest},
+	{
+		err: errUnknownParam, code: codeUnknownParam, title: "Unknown query parameter", status: http.StatusBadRequest,
+		allowed: func(*fieldView) []string { return searchParams },
+	},
+	{err: errBadRequestBody, code: codeBadRequestBody, title: "Malformed request body", status: http.StatusBadRequest, param: "body"},
+	{err: errBadLimitParam, code: codeBadLimit, title: "Invalid limit", status: http.StatusBadRequest, param: "limit"},
+	{err: errBadOffsetParam, code: codeBadOffset, title: "Invalid offset", status: http.StatusBadRequest, param: "offset"},
+	{
+		err: errBadOrderByParam, code: codeBadOrderBy, title: "Invalid order_by", status: http.StatusBadRequest, param: "order_by",
+		allowed: func(*fieldView) []string { return []string{"-1", "0", "1"} },
+	},
+	{
+		err: errBadOrderFieldParam, code: codeBadOrderField, title: "Invalid order_field", status: http.StatusBadRequest, param: "order_field",
+		allowed: func(view *fieldView) []string {
+			return view.names(func(f *userField) bool { return f.Sortable && view.usable(f.Name) })
+		},
+	},
+	{
+		err: errBadFieldsParam, code: codeBadFields, title: "Invalid fields", status: http.StatusBadRequest, param: "fields",
+		allowed: func(view *fieldView) []string {
+			return view.names(func(f *userField) bool { return view.readable(f.Name) })
+		},
+	},
+	{
+		err: errBadFilters, code: codeBadFilters, title: "Invalid filters", status: http.StatusBadRequest, param: "filters",
+		allowed: func(view *fieldView) []string {
+			return view.names(func(f *userField) bool { return view.usable(f.Name) })
+		},
+	},
+	{err: errBadLocaleParam, code: codeBadLocale, title: "Invalid locale", status: http.StatusBadRequest, param: "locale"},
+	{
+		err: errBadFormatParam, code: codeBadFormat, title: "Invalid format", status: http.StatusBadRequest, param: "format",
+		allowed: func(*fieldView) []string { return formatNames() },
+	},
+	{
+		err: errNotAcceptable, code: codeNotAcceptable, title: "Not acceptable", status: http.StatusNotAcceptable,
+		allowed: func(*fieldView) []string { return formatMediaTypes() },
+	},
+	{err: errBadIDParam, code: codeBadID, title: "Invalid user ID", status: http.StatusBadRequest, param: "id"},
+	{err: errBadIDsParam, code: codeBadIDs, title: "Invalid list of user IDs", status: http.StatusBadRequest, param: "ids"},
+	{err: errUserNotFound, code: codeUserNotFound, title: "User not found", status: http.StatusNotFound},
+	{err: errBadUser, code: codeBadUser, title: "Invalid user", status: http.StatusBadRequest},
+	{err: errUserExists, code: codeUserExists, title: "User already exists", status: http.StatusConflict, param: "id"},
+	{err: errPreconditionRequired, code: codeIfMatchRequired, title: "Precondition required", status: http.StatusPreconditionRequired},
+	{err: errPreconditionFailed, code: codeIfMatchFailed, title: "Precondition failed", status: http.StatusPreconditionFailed},
+	{err: errWritesDisabled, code: codeWritesDisabled, title: "Writes are disabled", status: http.StatusMethodNotAllowed},
+	{err: errParsingDatasetFailed, code: codeDatasetInvalid, title: "Dataset is invalid", status: http.StatusInternalServerError},
+	{err: errDatasetNotLoaded, code: codeDatasetUnavailable, title: "Dataset is not available", status: http.StatusInternalServerError},
+	{err: errDatasetLoading, code: codeDatasetLoading, title: "Dataset is still loading", status: http.StatusServiceUnavailable},
+}
+
+// paramError is one rejected request parameter. err is the sentinel that
+// decides the problem type, reason says what exactly is wrong. name is only
+// set when the sentinel doesn't imply the parameter.
+type paramError struct {
+	err    error
+	name   string
+	reason string
+}
+
+func newParamError(err error, format string, args ...interface{}) *paramError {
+	return &paramError{err: err, reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *paramError) Error() string {
+	if e.name != "" {
+		return e.err.Error() + " " + e.name + ": " + e.reason
+	}
+	return e.err.Error() + ": " + e.reason
+}
+
+func (e *paramError) Unwrap() error { return e.err }
+
+// validationErrors collects every rejected parameter of a request so that
+// the caller can fix them all at once.
+type validationErrors []*paramError
+
+func (errs *validationErrors) add(err error, format string, args ...interface{}) {
+	*errs = append(*errs, newParamError(err, format, args...))
+}
+
+// has reports whether the parameter guarded by sentinel was already rejected.
+func (errs validationErrors) has(sentinel error) bool {
+	for _, err := range errs {
+		if err.err == sentinel {
+			return true
+		}
+	}
+	return false
+}
+
+func (errs validationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (errs validationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs validationErrors) Unwrap() []error {
+	unwrapped := make([]error, 0, len(errs))
+	for _, err := range errs {
+		unwrapped = append(unwrapped, err)
+	}
+	return unwrapped
+}
+
+// problemFor describes err for the caller with the given field view.
+// Errors that aren't part of the API contract become an opaque internal error.
+func problemFor(err error, view *fieldView) ErrorServer {
+	var errs validationErrors
+	if errors.As(err, &errs) && len(errs) > 0 {
+		return validationProblem(errs, view)
+	}
+
+	for _, pt := range problemTypes {
+		if !errors.Is(err, pt.err) {
+			continue
+		}
+
+		problem := ErrorServer{
+			Error:  pt.err.Error(),
+			Code:   pt.code,
+			Title:  pt.title,
+			Status: pt.status,
+			Detail: err.Error(),
+			Param:  pt.param,
+		}
+		if pt.allowed != nil {
+			problem.Allowed = pt.allowed(view)
+		}
+		return problem
+	}
+
+	return ErrorServer{
+		Error:  errInternal.Error(),
+		Code:   codeInternal,
+		Title:  "Internal server error",
+		Status: http.StatusInternalServerError,
+	}
+}
+
+// validationProblem lists every rejected parameter in invalid_params. The
+// top-level fields describe the first one, so clients that only know a
+// single error keep working.
+func validationProblem(errs validationErrors, view *fieldView) ErrorServer {
+	problem := problemFor(errs[0], view)
+	problem.Detail = errs.Error()
+	for _, err := range errs {
+		entry := problemFor(err, view)
+		if err.name != "" {
+			entry.Param = err.name
+		}
+		if len(problem.InvalidParams) == 0 {
+			problem.Param = entry.Param
+		}
+		problem.InvalidParams = append(problem.InvalidParams, InvalidParamServer{
+			Name:    entry.Param,
+			Code:    entry.Code,
+			Reason:  err.reason,
+			Allowed: entry.Allowed,
+		})
+	}
+	return problem
+}
+
+func sendProblem(w http.ResponseWriter, r *http.Request, err error) {
+	problem := problemFor(err, viewFromContext(r.Context()))
+	sendJSONError(w, r, problem, problem.Status)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// fallbackErrorBody is sent when even the error response can't be encoded.
+const fallbackErrorBody = `{"error":"internal server error","code":"internal_error","status":500}` + "\n"
+
+// sendJSON encodes v before touching the ResponseWriter, so an encoding
+// failure still ends up as a well-formed 500 instead of a half-written 200.
+func sendJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	sendJSONStatus(w, r, http.StatusOK, v)
+}
+
+func sendJSONStatus(w http.ResponseWriter, r *http.Request, statusCode int, v interface{}) {
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		loggerFromContext(r.Context()).Error("sendJSON: Failed to encode response", slog.String("error", err.Error()))
+		sendProblem(w, r, errInternal)
+		return
+	}
+	if sizer, ok := v.(resultSizer); ok {
+		noteResultSize(w, sizer.resultSize())
+	}
+	writeBody(w, r, "application/json", statusCode, buf.Bytes())
+}
+
+// sendJSONError writes msg as application/problem+json, filling in the members
+// that are derived from the request and the status code.
+func sendJSONError(w http.ResponseWriter, r *http.Request, msg ErrorServer, statusCode int) {
+	msg.Status = statusCode
+	msg.Instance = r.URL.Path
+	msg.RequestID = requestInfoFromContext(r.Context()).id()
+	if msg.Code != "" {
+		msg.Type = problemTypePrefix + msg.Code
+	}
+	if msg.Title == "" {
+		msg.Title = http.StatusText(statusCode)
+	}
+
+	noteProblem(w, msg)
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("sendJSONError: Failed to encode response", slog.String("error", err.Error()))
+		writeBody(w, r, problemContentType, http.StatusInternalServerError, []byte(fallbackErrorBody))
+		return
+	}
+	writeBody(w, r, problemContentType, statusCode, append(body, '\n'))
+}
+
+func writeBody(w http.ResponseWriter, r *http.Request, contentType string, statusCode int, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(body); err != nil {
+		loggerFromContext(r.Context()).Warn("writeBody: Failed to send response", slog.String("error", err.Error()))
+	}
+}
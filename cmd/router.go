@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+const apiVersion = "v1"
+
+var (
+	errDatasetNotLoaded = errors.New("dataset is not loaded")
+	errDatasetLoading   = errors.New("dataset is still loading")
+)
+
+type CapabilitiesServer struct {
+	Version      string
+	Endpoints    []string
+	Fields       []string
+	OrderFields  []string
+	MaxBatchIDs  int
+	SearchParams []string
+	Formats      []string
+	Defaults     SearchDefaultsServer
+	StrictParams bool
+	SearchBody   *jsonSchema
+}
+
+// SearchDefaultsServer are the values used for omitted search parameters.
+type SearchDefaultsServer struct {
+	Limit   int
+	Offset  int
+	OrderBy int
+	Locale  string
+}
+
+var routes = []string{
+	"GET /v1/users/search",
+	"POST /v1/users/search",
+	"GET /v1/users/{id}",
+	"GET /v1/users",
+	"POST /v1/users",
+	"PUT /v1/users/{id}",
+	"PATCH /v1/users/{id}",
+	"DELETE /v1/users/{id}",
+	"GET /v1/capabilities",
+	"GET /v1/status",
+	"GET /v1/diagnostics",
+	"GET /healthz",
+	"GET /readyz",
+	"GET /metrics",
+}
+
+// NewRouter wires all endpoints of the service. The root path keeps serving
+// SearchServer query semantics for clients that predate the versioned API.
+func NewRouter() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, withRoute(pattern, h))
+	}
+
+	handle("GET /v1/users/search", requireAuth(scopeUsersRead, searchUsers))
+	handle("POST /v1/users/search", requireAuth(scopeUsersRead, searchUsers))
+	handle("GET /v1/users/{id}", requireAuth(scopeUsersRead, getUser))
+	handle("GET /v1/users", requireAuth(scopeUsersRead, getUsers))
+	handle("POST /v1/users", requireAuth(scopeUsersWrite, createUser))
+	handle("PUT /v1/users/{id}", requireAuth(scopeUsersWrite, replaceUser))
+	handle("PATCH /v1/users/{id}", requireAuth(scopeUsersWrite, patchUser))
+	handle("DELETE /v1/users/{id}", requireAuth(scopeUsersWrite, deleteUser))
+	handle("GET /v1/capabilities", http.HandlerFunc(capabilities))
+	handle("GET /v1/status", requireAuth(scopeUsersRead, datasetStatus))
+	handle("GET /v1/diagnostics", requireAuth(scopeUsersRead, datasetDiagnostics))
+	handle("GET /healthz", http.HandlerFunc(healthz))
+	handle("GET /readyz", http.HandlerFunc(readyz))
+	handle("GET /metrics", http.HandlerFunc(serveMetrics))
+
+	handle("GET /{$}", http.HandlerFunc(SearchServer))
+	handle("POST /{$}", http.HandlerFunc(SearchServer))
+	handle("GET /users/{id}", http.HandlerFunc(GetUserServer))
+	handle("GET /users", http.HandlerFunc(GetUsersServer))
+
+	return chain(mux, withRequestID, withTracing, withMetrics, withLogging, withRecovery, withCompression)
+}
+
+func capabilities(w http.ResponseWriter, r *http.Request) {
+	resp := CapabilitiesServer{
+		Version:      apiVersion,
+		Endpoints:    routes,
+		MaxBatchIDs:  maxBatchIDs,
+		SearchParams: searchParams,
+		Formats:      formatNames(),
+		Defaults:     SearchDefaultsServer{Limit: defaultLimit, Offset: defaultOffset, OrderBy: defaultOrderBy, Locale: defaultLocale},
+		StrictParams: strictParams,
+		SearchBody:   searchBodySchema,
+	}
+	for _, field := range userFields {
+		resp.Fields = append(resp.Fields, field.Name)
+		if field.Sortable {
+			resp.OrderFields = append(resp.OrderFields, field.Name)
+		}
+	}
+	sendJSON(w, r, resp)
+}
+
+// healthz only tells that the process is alive and serving HTTP.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, r, map[string]string{"status": "ok"})
+}
+
+// readyz fails until the configured dataset has been parsed successfully.
+// While the first load runs, it answers at once instead of waiting for it.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if _, err := store.current(database); err != nil {
+		problem := problemFor(errDatasetNotLoaded, nil)
+		if errors.Is(err, errDatasetLoading) {
+			problem = problemFor(errDatasetLoading, nil)
+		}
+		problem.Detail = err.Error()
+		sendJSONError(w, r, problem, http.StatusServiceUnavailable)
+		return
+	}
+	sendJSON(w, r, map[string]string{"status": "ready"})
+}
+
+func datasetStatus(w http.ResponseWriter, r *http.Request) {
+	if !store.busy() {
+		store.current(database) //nolint:errcheck
+	}
+	sendJSON(w, r, store.status())
+}
+
+// datasetDiagnostics lists the rows the last lenient load skipped.
+func datasetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !store.busy() {
+		store.current(database) //nolint:errcheck
+	}
+	sendJSON(w, r, store.diagnostics())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	schemaObject  = "object"
+	schemaArray   = "array"
+	schemaString  = "string"
+	schemaInteger = "integer"
+)
+
+// jsonSchema is the subset of JSON Schema the request bodies need. It is
+// published by GET /v1/capabilities and checked before a body is decoded, so
+// every violation is reported instead of the first decoding error.
+type jsonSchema struct {
+	Type                 string                 `json:"type,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	MaxItems             int                    `json:"maxItems,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+}
+
+var (
+	stringSchema  = &jsonSchema{Type: schemaString}
+	integerSchema = &jsonSchema{Type: schemaInteger}
+
+	// searchBodySchema describes the body of POST /v1/users/search, it mirrors SearchRequest.
+	searchBodySchema = objectSchema(nil, map[string]*jsonSchema{
+		"Limit":      integerSchema,
+		"Offset":     integerSchema,
+		"Query":      stringSchema,
+		"OrderField": stringSchema,
+		"OrderBy":    integerSchema,
+		"Locale":     stringSchema,
+		"Fields":     {Type: schemaArray, Nullable: true, Items: stringSchema},
+		"Filters": {Type: schemaArray, Nullable: true, MaxItems: maxFilters, Items: objectSchema(
+			[]string{"Field", "Op", "Value"},
+			map[string]*jsonSchema{
+				"Field": stringSchema,
+				"Op":    {Type: schemaString, Enum: stringFilterOps},
+				"Value": {AnyOf: []*jsonSchema{
+					stringSchema,
+					integerSchema,
+					{Type: schemaArray, Items: &jsonSchema{AnyOf: []*jsonSchema{stringSchema, integerSchema}}},
+				}},
+			},
+		)},
+	})
+)
+
+func objectSchema(required []string, properties map[string]*jsonSchema) *jsonSchema {
+	closed := false
+	return &jsonSchema{Type: schemaObject, Properties: properties, Required: required, AdditionalProperties: &closed}
+}
+
+// validate checks a document decoded with UseNumber and records a violation
+// for every value that doesn't fit, path names the value in the body.
+func (s *jsonSchema) validate(path string, value interface{}, errs *validationErrors) {
+	if value == nil && s.Nullable {
+		return
+	}
+
+	if len(s.AnyOf) > 0 {
+		for _, alt := range s.AnyOf {
+			var altErrs validationErrors
+			if alt.validate(path, value, &altErrs); len(altErrs) == 0 {
+				return
+			}
+		}
+		*errs = append(*errs, schemaError(path, "has an unexpected type"))
+		return
+	}
+
+	switch s.Type {
+	case schemaObject:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			*errs = append(*errs, schemaError(path, "must be an object"))
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				*errs = append(*errs, schemaError(joinSchemaPath(path, name), "is required"))
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				*errs = append(*errs, schemaError(joinSchemaPath(path, name), "is not a known property"))
+				continue
+			}
+			property.validate(joinSchemaPath(path, name), object[name], errs)
+		}
+	case schemaArray:
+		items, ok := value.([]interface{})
+		if !ok {
+			*errs = append(*errs, schemaError(path, "must be an array"))
+			return
+		}
+		if s.MaxItems > 0 && len(items) > s.MaxItems {
+			*errs = append(*errs, schemaError(path, fmt.Sprintf("must have at most %d items", s.MaxItems)))
+			return
+		}
+		for i, item := range items {
+			s.Items.validate(path+"["+strconv.Itoa(i)+"]", item, errs)
+		}
+	case schemaString:
+		str, ok := value.(string)
+		if !ok {
+			*errs = append(*errs, schemaError(path, "must be a string"))
+			return
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			*errs = append(*errs, schemaError(path, "must be one of "+strings.Join(s.Enum, ", ")))
+		}
+	case schemaInteger:
+		number, ok := value.(json.Number)
+		if _, err := number.Int64(); !ok || err != nil {
+			*errs = append(*errs, schemaError(path, "must be an integer"))
+		}
+	}
+}
+
+func schemaError(path, reason string) *paramError {
+	if path == "" {
+		path = "body"
+	}
+	return &paramError{err: errBadRequestBody, name: path, reason: reason}
+}
+
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -1,19 +1,18 @@
 package main
 
 import (
-	"encoding/json"
-	"encoding/xml"
+	"cmp"
+	"context"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
 	"slices"
 	"strconv"
 	"strings"
 
-	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 type SearchRequestServer struct {
@@ -22,6 +21,9 @@ type SearchRequestServer struct {
 	Query      string
 	OrderField string
 	OrderBy    int
+	Fields     []string
+	Filters    []SearchFilterServer
+	Locale     string
 }
 
 type UsersServer struct {
@@ -29,245 +31,334 @@ type UsersServer struct {
 }
 
 type UserServer struct {
-	ID      int    `xml:"id"`
-	Name    string `xml:"first_name"`
-	Surname string `xml:"last_name"`
-	Age     int    `xml:"age"`
-	About   string `xml:"about"`
-	Gender  string `xml:"gender"`
+	ID      int    `xml:"id" json:"id"`
+	Name    string `xml:"first_name" json:"first_name"`
+	Surname string `xml:"last_name" json:"last_name"`
+	Age     int    `xml:"age" json:"age"`
+	About   string `xml:"about" json:"about"`
+	Gender  string `xml:"gender" json:"gender"`
+	Email   string `xml:"email" json:"email"`
+	Phone   string `xml:"phone" json:"phone"`
+	Address string `xml:"address" json:"address"`
 }
 
 type UserClient struct {
-	ID     int
-	Name   string
-	Age    int
-	About  string
-	Gender string
+	ID        int
+	Name      string
+	FirstName string
+	LastName  string
+	Age       int
+	About     string
+	Gender    string
+	Email     string
+	Phone     string
+	Address   string
 }
 
+// ErrorServer is an RFC 7807 problem. Error keeps the free-text message that
+// older clients match on.
 type ErrorServer struct {
-	Error string `json:"error"`
+	Type      string   `json:"type,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	Status    int      `json:"status,omitempty"`
+	Detail    string   `json:"detail,omitempty"`
+	Instance  string   `json:"instance,omitempty"`
+	Error     string   `json:"error"`
+	Code      string   `json:"code,omitempty"`
+	Param     string   `json:"param,omitempty"`
+	Allowed   []string `json:"allowed,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+
+	InvalidParams []InvalidParamServer `json:"invalid_params,omitempty"`
+}
+
+// InvalidParamServer is one entry of the invalid_params extension member.
+type InvalidParamServer struct {
+	Name    string   `json:"name"`
+	Code    string   `json:"code"`
+	Reason  string   `json:"reason"`
+	Allowed []string `json:"allowed,omitempty"`
 }
 
 const (
 	ageFieldName  = "age"
 	nameFieldName = "name"
 	idFieldName   = "id"
+
+	// defaults for search parameters the request leaves out or sends empty
+	defaultOffset  = 0
+	defaultOrderBy = OrderByAsIs
+)
+
+// searchParams are the query parameters SearchServer understands.
+var searchParams = []string{"query", "order_field", "order_by", "limit", "offset", "fields", "format", "locale"}
+
+var (
+	// defaultLimit is the page size for requests without limit.
+	defaultLimit = 25
+	// strictParams rejects unknown query parameters instead of ignoring them with a warning.
+	strictParams = false
+	// defaultLocale is the collation for requests without locale, see -locale.
+	defaultLocale = "und"
 )
 
 var (
-	SecretToken           = []byte("secret")
-	database              = "dataset.xml"
-	errBadOrderFieldParam = errors.New(ErrorBadOrderField)
-	errParsingXMLFailed   = errors.New("failed to parse file")
-	errBadLimitParam      = errors.New("bad limit param")
-	errBadOffsetParam     = errors.New("bad offset param")
-	errBadOrderByParam    = errors.New("bad order_by param")
-	errBadQueryParams     = errors.New("bad query params")
-	errBadAccessToken     = errors.New("bad AccessToken")
+	SecretToken             = []byte("secret")
+	database                = "dataset.xml"
+	errBadOrderFieldParam   = errors.New(ErrorBadOrderField)
+	errBadFieldsParam       = errors.New(ErrorBadFields)
+	errParsingDatasetFailed = errors.New("failed to parse file")
+	errBadLimitParam        = errors.New("bad limit param")
+	errBadOffsetParam       = errors.New("bad offset param")
+	errBadOrderByParam      = errors.New("bad order_by param")
+	errBadLocaleParam       = errors.New("bad locale param")
+	errBadQueryParams       = errors.New("bad query params")
+	errUnknownParam         = errors.New("unknown query param")
+	errBadAccessToken       = errors.New("bad AccessToken")
+	errInsufficientScope    = errors.New("insufficient scope")
+	errInternal             = errors.New("internal server error")
 )
 
+// SearchServer is the legacy entry point that checks the AccessToken on its own.
 func SearchServer(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("AccessToken")
-	err := authCheck(token)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	withRecovery(requireAuth(scopeUsersRead, searchUsers)).ServeHTTP(w, r)
+}
 
-	enc := json.NewEncoder(w)
+func searchUsers(w http.ResponseWriter, r *http.Request) {
+	view := viewFromContext(r.Context())
 
-	sendErrorResponse := func(errMsg string, statusCode int) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(statusCode)
-		Msg := ErrorServer{Error: errMsg}
-		if err = enc.Encode(Msg); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+	var params *SearchRequestServer
+	var format *outputFormat
+	var err error
+	traced(r.Context(), "parse_params", func() {
+		var errs validationErrors
+		if r.Method == http.MethodPost {
+			params, err = parseBodyParams(w, r)
+		} else {
+			params, errs = parseQueryParams(r.URL.Query())
+			errs = append(errs, checkUnknownParams(w, r)...)
 		}
-	}
-
-	rawParams := r.URL.Query()
-	params, err := parseQueryParams(rawParams)
+		if err != nil {
+			return
+		}
+		if format, err = negotiateFormat(r, &errs); err == nil {
+			err = validateQueryParams(params, view, errs)
+		}
+	})
 	if err != nil {
-		sendErrorResponse(err.Error(), http.StatusBadRequest)
+		loggerFromContext(r.Context()).Debug("validateQueryParams: rejected", slog.String("error", err.Error()))
+		sendProblem(w, r, err)
 		return
 	}
 
-	err = validateQueryParams(params)
-	if err != nil {
-		log.Printf("validateQueryParams: %s\n", err.Error())
-		sendErrorResponse(err.Error(), http.StatusBadRequest)
-		return
-	}
+	requestInfoFromContext(r.Context()).setParams(params.logValue())
 
-	data, err := os.ReadFile(database)
-	if err != nil {
-		log.Printf("SearchServer: Failed to read %s: %s\n", database, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	snapshot, ok := loadDataset(w, r)
+	if !ok {
 		return
 	}
 
-	users, err := parseUsers(data)
-	if err != nil {
-		log.Printf("parseUsers: %s\n", err.Error())
-		sendErrorResponse(err.Error(), http.StatusInternalServerError)
-		return
+	users := processUsers(r.Context(), snapshot.list(), *params, view)
+	if len(params.Fields) > 0 {
+		view = view.selected(params.Fields)
 	}
 
-	users = processUsers(users, *params)
+	traced(r.Context(), "encode", func() {
+		sendUsers(w, r, format, view, users)
+	})
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err = enc.Encode(users); err != nil {
-		log.Printf("SearchServer: Failed to send response: %s\n", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+func loadDataset(w http.ResponseWriter, r *http.Request) (*usersSnapshot, bool) {
+	_, span := tracer.Start(r.Context(), "dataset")
+	snapshot, err := store.current(database)
+	span.RecordError(err)
+	span.End()
+
+	switch {
+	case err == nil:
+		return snapshot, true
+	case errors.Is(err, errDatasetLoading):
+		sendProblem(w, r, err)
+	case errors.Is(err, errParsingDatasetFailed):
+		loggerFromContext(r.Context()).Error("loadDataset: Failed to parse dataset", slog.String("path", database), slog.String("error", err.Error()))
+		sendProblem(w, r, err)
+	default:
+		loggerFromContext(r.Context()).Error("loadDataset: Failed to read dataset", slog.String("path", database), slog.String("error", err.Error()))
+		sendProblem(w, r, errDatasetNotLoaded)
 	}
+	return nil, false
 }
 
-func authCheck(token string) error {
-	hashSecretGetter := func(token *jwt.Token) (interface{}, error) {
-		return SecretToken, nil
+// logValue is the normalized form of the request that goes to the request log.
+func (params *SearchRequestServer) logValue() map[string]interface{} {
+	value := map[string]interface{}{
+		"limit":       params.Limit,
+		"offset":      params.Offset,
+		"query":       params.Query,
+		"order_field": params.OrderField,
+		"order_by":    params.OrderBy,
 	}
-
-	parsedToken, err := jwt.Parse(token, hashSecretGetter)
-	if err != nil || !parsedToken.Valid {
-		return errBadAccessToken
+	if len(params.Fields) > 0 {
+		value["fields"] = params.Fields
 	}
-
-	return nil
+	if len(params.Filters) > 0 {
+		value["filters"] = len(params.Filters)
+	}
+	if params.Locale != "" {
+		value["locale"] = params.Locale
+	}
+	return value
 }
 
-func parseQueryParams(rawParams url.Values) (*SearchRequestServer, error) {
-	rawLimit := rawParams.Get("limit")
-	limit, err := strconv.Atoi(rawLimit)
-	if err != nil {
-		return nil, errBadQueryParams
+func parseQueryParams(rawParams url.Values) (*SearchRequestServer, validationErrors) {
+	var errs validationErrors
+	params := &SearchRequestServer{
+		Query:      rawParams.Get("query"),
+		OrderField: rawParams.Get("order_field"),
+		Locale:     rawParams.Get("locale"),
 	}
+	params.Limit = parseIntParam(rawParams, "limit", defaultLimit, errBadLimitParam, &errs)
+	params.Offset = parseIntParam(rawParams, "offset", defaultOffset, errBadOffsetParam, &errs)
+	params.OrderBy = parseIntParam(rawParams, "order_by", defaultOrderBy, errBadOrderByParam, &errs)
 
-	rawOffset := rawParams.Get("offset")
-	offset, err := strconv.Atoi(rawOffset)
-	if err != nil {
-		return nil, errBadQueryParams
+	if rawFields := rawParams.Get("fields"); rawFields != "" {
+		params.Fields = strings.Split(rawFields, ",")
 	}
 
-	rawOrderBy := rawParams.Get("order_by")
-	orderBy, err := strconv.Atoi(rawOrderBy)
+	return params, errs
+}
+
+// parseIntParam falls back to def when the parameter is missing or empty.
+func parseIntParam(rawParams url.Values, name string, def int, sentinel error, errs *validationErrors) int {
+	raw := rawParams.Get(name)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.Atoi(raw)
 	if err != nil {
-		return nil, errBadQueryParams
+		errs.add(sentinel, "must be an integer, got %q", raw)
+		return 0
 	}
+	return value
+}
 
-	return &SearchRequestServer{
-		Limit:      limit,
-		Offset:     offset,
-		Query:      rawParams.Get("query"),
-		OrderField: rawParams.Get("order_field"),
-		OrderBy:    orderBy,
-	}, nil
+// checkUnknownParams rejects query parameters SearchServer doesn't know in
+// strict mode. Otherwise they are ignored and reported in a Warning header.
+func checkUnknownParams(w http.ResponseWriter, r *http.Request) validationErrors {
+	var errs validationErrors
+	for _, name := range sortedKeys(r.URL.Query()) {
+		if slices.Contains(searchParams, name) {
+			continue
+		}
+		if strictParams {
+			errs = append(errs, &paramError{err: errUnknownParam, name: name, reason: "is not a known parameter"})
+			continue
+		}
+		loggerFromContext(r.Context()).Warn("checkUnknownParams: Ignoring unknown query parameter", slog.String("param", name))
+		w.Header().Add("Warning", "299 - "+strconv.Quote("unknown query parameter "+name+" is ignored"))
+	}
+	return errs
 }
 
-func validateQueryParams(params *SearchRequestServer) error {
-	if params.OrderField != "" && params.OrderField != nameFieldName &&
-		params.OrderField != ageFieldName && params.OrderField != idFieldName {
-		return errBadOrderFieldParam
+// validateQueryParams checks every parameter and reports all problems at once.
+// errs holds what parsing already rejected, those parameters aren't checked again.
+func validateQueryParams(params *SearchRequestServer, view *fieldView, errs validationErrors) error {
+	if params.OrderField != "" {
+		field := lookupUserField(params.OrderField)
+		if field == nil || !field.Sortable || !view.usable(field.Name) {
+			errs.add(errBadOrderFieldParam, "%q is not a sortable field", params.OrderField)
+		}
 	}
-	if params.Limit <= 0 {
-		return errBadLimitParam
+	for _, name := range params.Fields {
+		if !view.readable(name) {
+			errs.add(errBadFieldsParam, "%q is not a readable field", name)
+		}
 	}
-	if params.Offset < 0 {
-		return errBadOffsetParam
+	validateFilters(params.Filters, view, &errs)
+	if params.Locale != "" {
+		if _, err := language.Parse(params.Locale); err != nil {
+			errs.add(errBadLocaleParam, "%q is not a BCP 47 language tag", params.Locale)
+		}
 	}
-	switch params.OrderBy {
-	case -1, 0, 1:
-		return nil
-	default:
-		return errBadOrderByParam
+	if !errs.has(errBadLimitParam) && params.Limit <= 0 {
+		errs.add(errBadLimitParam, "must be greater than 0")
 	}
-}
-
-func parseUsers(data []byte) ([]UserClient, error) {
-	users := UsersServer{}
-	err := xml.Unmarshal(data, &users)
-	if err != nil {
-		return nil, errParsingXMLFailed
+	if !errs.has(errBadOffsetParam) && params.Offset < 0 {
+		errs.add(errBadOffsetParam, "must not be negative")
 	}
-
-	unexpectedChars := string([]rune{10, 32})
-	parsedUsers := make([]UserClient, 0, len(users.Users))
-	for _, user := range users.Users {
-		parsedUsers = append(parsedUsers, UserClient{
-			ID:     user.ID,
-			Name:   fmt.Sprintf("%s %s", user.Name, user.Surname),
-			Age:    user.Age,
-			About:  strings.TrimRight(user.About, unexpectedChars),
-			Gender: user.Gender,
-		})
+	if !errs.has(errBadOrderByParam) && params.OrderBy != -1 && params.OrderBy != 0 && params.OrderBy != 1 {
+		errs.add(errBadOrderByParam, "must be one of -1, 0, 1")
 	}
-	return parsedUsers, nil
+	return errs.err()
 }
 
-func processUsers(users []UserClient, params SearchRequestServer) []UserClient {
-	users = filterUsers(users, params.Query)
+func processUsers(ctx context.Context, users []UserClient, params SearchRequestServer, view *fieldView) []UserClient {
+	traced(ctx, "filter", func() {
+		users = filterUsers(users, params.Query, view)
+		users = applyFilters(users, params.Filters, view)
+	})
 	if params.Offset >= len(users) {
 		return []UserClient{}
 	}
 
-	users = sortUsers(users, params.OrderField, params.OrderBy)
-	users = paginateUsers(users, params.Offset, params.Limit)
+	traced(ctx, "sort", func() {
+		users = sortUsers(users, params.OrderField, params.OrderBy, params.Locale)
+	})
+	traced(ctx, "paginate", func() {
+		users = paginateUsers(users, params.Offset, params.Limit)
+	})
 	return users
 }
 
-func filterUsers(users []UserClient, query string) []UserClient {
-	if query != "" {
-		users = slices.DeleteFunc(users, func(item UserClient) bool {
-			return !strings.Contains(item.Name, query) && !strings.Contains(item.About, query)
-		})
+func filterUsers(users []UserClient, query string, view *fieldView) []UserClient {
+	if query == "" {
+		return users
 	}
-	return users
-}
 
-func sortUsers(users []UserClient, orderField string, orderBy int) []UserClient {
-	sortByFieldAndOrder := func(users []UserClient, order int, sortFunc func(a, b UserClient) int) {
-		if order < 0 {
-			slices.SortStableFunc(users, func(aa, bb UserClient) int {
-				return -sortFunc(aa, bb)
-			})
-		} else {
-			slices.SortStableFunc(users, sortFunc)
+	searchable := make([]*userField, 0, len(userFields))
+	for _, field := range userFields {
+		if field.Searchable && view.usable(field.Name) {
+			searchable = append(searchable, field)
 		}
 	}
 
-	compareUsersByAge := func(a, b UserClient) int {
-		if a.Age < b.Age {
-			return -1
+	return slices.DeleteFunc(users, func(item UserClient) bool {
+		for _, field := range searchable {
+			if strings.Contains(field.value(item).(string), query) {
+				return false
+			}
 		}
-		if a.Age > b.Age {
-			return 1
-		}
-		return 0
+		return true
+	})
+}
+
+// sortUsers orders users by orderField, users that compare equal go by ID.
+// Collated fields follow the rules of locale, or of defaultLocale if it's empty.
+func sortUsers(users []UserClient, orderField string, orderBy int, locale string) []UserClient {
+	if orderBy == 0 {
+		return users
+	}
+	if orderField == "" {
+		orderField = nameFieldName
 	}
 
-	compareUsersByID := func(a, b UserClient) int {
-		if a.ID < b.ID {
-			return -1
-		}
-		if a.ID > b.ID {
-			return 1
-		}
-		return 0
+	field := lookupUserField(orderField)
+	if field == nil || field.compare == nil {
+		return users
 	}
 
-	if orderBy != 0 {
-		switch orderField {
-		case "", nameFieldName:
-			sortByFieldAndOrder(users, orderBy, func(a, b UserClient) int {
-				return strings.Compare(a.Name, b.Name)
-			})
-		case ageFieldName:
-			sortByFieldAndOrder(users, orderBy, compareUsersByAge)
-		case idFieldName:
-			sortByFieldAndOrder(users, orderBy, compareUsersByID)
+	compare := field.compare
+	if field.Collated {
+		// a collator keeps state between comparisons, so it can't be shared across requests
+		collator := collate.New(language.Make(cmp.Or(locale, defaultLocale)))
+		compare = func(a, b UserClient) int {
+			return collator.CompareString(field.value(a).(string), field.value(b).(string))
 		}
 	}
-
+	slices.SortFunc(users, func(a, b UserClient) int {
+		return cmp.Or(orderBy*compare(a, b), cmp.Compare(a.ID, b.ID))
+	})
 	return users
 }
 
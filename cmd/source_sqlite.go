@@ -0,0 +1,102 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	userSources[sourceSQLite] = sqliteSource{}
+	datasetCompactors[sourceSQLite] = compactSQLite
+}
+
+// sqliteSource reads the users table of an SQLite database. The table has the
+// columns of the dataset.xml row schema, NULLs are read as empty values.
+type sqliteSource struct{}
+
+const sqliteUsersQuery = `SELECT id, COALESCE(first_name, ''), COALESCE(last_name, ''), COALESCE(age, 0),
+	COALESCE(about, ''), COALESCE(gender, ''), COALESCE(email, ''), COALESCE(phone, ''), COALESCE(address, '')
+	FROM users ORDER BY rowid`
+
+func (sqliteSource) Load(path string, loader *datasetLoader) error {
+	db, err := sql.Open("sqlite3", "file:"+url.PathEscape(path)+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(sqliteUsersQuery)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := UserServer{}
+		err = rows.Scan(&row.ID, &row.Name, &row.Surname, &row.Age, &row.About, &row.Gender, &row.Email, &row.Phone, &row.Address)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+		}
+		loader.add(row.toUserClient())
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+	}
+	return nil
+}
+
+const (
+	sqliteUpdateUser = `UPDATE users SET first_name = ?, last_name = ?, age = ?, about = ?, gender = ?, email = ?, phone = ?, address = ?
+	WHERE id = ?`
+	sqliteInsertUser = `INSERT INTO users (first_name, last_name, age, about, gender, email, phone, address, id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	sqliteDeleteUser = `DELETE FROM users WHERE id = ?`
+)
+
+// compactSQLite applies the mutations to the users table in one transaction.
+// Columns the server doesn't serve keep their values. SQLite tables are always
+// loaded strictly, so there are no rejected rows to deal with.
+func compactSQLite(path string, mutations []mutation, _ bool) error {
+	db, err := sql.Open("sqlite3", "file:"+url.PathEscape(path)+"?mode=rw")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+	for _, m := range mutations {
+		if m.Op == mutationDelete {
+			if _, err = tx.Exec(sqliteDeleteUser, m.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		user := m.User
+		values := []interface{}{user.Name, user.Surname, user.Age, user.About, user.Gender, user.Email, user.Phone, user.Address, user.ID}
+		result, err := tx.Exec(sqliteUpdateUser, values...)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err = tx.Exec(sqliteInsertUser, values...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
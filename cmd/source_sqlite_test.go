@@ -0,0 +1,83 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE users (id INTEGER, first_name TEXT, last_name TEXT, age INTEGER,
+		about TEXT, gender TEXT, email TEXT, phone TEXT, address TEXT, company TEXT)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO users VALUES (7, 'Ann', 'Lee', 30, 'About Ann', 'female', 'ann@example.com', '+1', 'Main St', 'ACME'),
+		(3, 'Bob', NULL, NULL, NULL, 'male', NULL, NULL, NULL, NULL)`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	format, source, err := sourceFor(path, sourceAuto)
+	assert.NoError(t, err)
+	assert.Equal(t, sourceSQLite, format)
+	loader := newDatasetLoader()
+	assert.NoError(t, source.Load(path, loader))
+	assert.Equal(t, []UserClient{
+		{ID: 7, Name: "Ann Lee", FirstName: "Ann", LastName: "Lee", Age: 30, About: "About Ann", Gender: "female", Email: "ann@example.com", Phone: "+1", Address: "Main St"},
+		{ID: 3, Name: "Bob", FirstName: "Bob", Gender: "male"},
+	}, loader.users)
+	assert.Equal(t, LoadProgress{Rows: 2}, loader.progress())
+
+	err = source.Load(filepath.Join(t.TempDir(), "missing.db"), newDatasetLoader())
+	assert.Error(t, err)
+}
+
+func TestSQLiteCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path, logPath := filepath.Join(dir, "users.db"), filepath.Join(dir, "mutations.jsonl")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE users (id INTEGER, first_name TEXT, last_name TEXT, age INTEGER,
+		about TEXT, gender TEXT, email TEXT, phone TEXT, address TEXT, company TEXT)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO users VALUES (7, 'Ann', 'Lee', 30, 'About Ann', 'female', 'ann@example.com', '+1', 'Main St', 'ACME'),
+		(3, 'Bob', NULL, NULL, NULL, 'male', NULL, NULL, NULL, NULL)`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	mutations := []mutation{
+		{Op: mutationPut, ID: 7, User: &UserServer{ID: 7, Name: "Ann", Surname: "Lee", Age: 31, Gender: "female"}},
+		{Op: mutationDelete, ID: 3},
+		{Op: mutationPut, ID: 9, User: &UserServer{ID: 9, Name: "Cem", Age: 40, Gender: "male"}},
+	}
+	for _, m := range mutations {
+		assert.NoError(t, appendMutation(logPath, m))
+	}
+	mutationLog = logPath
+	defer func() { mutationLog = "" }()
+	before, err := (&userStore{}).load(path)
+	assert.NoError(t, err)
+
+	n, err := compactMutations(path, sourceAuto, logPath, false)
+	assert.NoError(t, err)
+	assert.Equal(t, len(mutations), n)
+	info, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size(), "The log must be emptied")
+	compacted, err := (&userStore{}).load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, before.users, compacted.users, "Compaction must keep the users")
+
+	db, err = sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	var company string
+	assert.NoError(t, db.QueryRow(`SELECT company FROM users WHERE id = 7`).Scan(&company))
+	assert.Equal(t, "ACME", company, "Columns the server doesn't serve must be kept")
+}
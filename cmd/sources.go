@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	sourceAuto   = "auto"
+	sourceXML    = "xml"
+	sourceJSON   = "json"
+	sourceJSONL  = "jsonl"
+	sourceCSV    = "csv"
+	sourceSQLite = "sqlite"
+
+	loadModeStrict  = "strict"
+	loadModeLenient = "lenient"
+
+	// maxRejectedRows caps how many rejected rows a lenient load keeps for diagnostics.
+	maxRejectedRows = 1000
+)
+
+var (
+	// datasetFormat is the format of the dataset file, see -dataset-format.
+	// auto picks it by the file extension.
+	datasetFormat = sourceAuto
+	// datasetLoadMode is strict or lenient, see -dataset-mode. A lenient load
+	// skips malformed rows instead of failing.
+	datasetLoadMode = loadModeStrict
+
+	errUnknownSourceFormat = errors.New("unknown dataset format")
+)
+
+// UserSource reads every user of a dataset export. Exports of all formats
+// share the row schema of dataset.xml: id, first_name, last_name, age, about,
+// gender, email, phone and address. Other columns are ignored.
+//
+// Sources hand users to the loader one at a time, in file order, so memory
+// spent on decoding doesn't grow with the size of the export.
+type UserSource interface {
+	Load(path string, loader *datasetLoader) error
+}
+
+// streamSource is a UserSource for formats that are decoded from one stream.
+type streamSource func(r io.Reader, loader *datasetLoader) error
+
+func (decode streamSource) Load(path string, loader *datasetLoader) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil {
+		loader.bytesTotal.Store(info.Size())
+	}
+	return decode(bufio.NewReaderSize(loader.reader(f), 64<<10), loader)
+}
+
+// userSources lists the available formats. SQLite registers itself when
+// the server is built with the sqlite tag.
+var userSources = map[string]UserSource{
+	sourceXML:   streamSource(decodeXMLDataset),
+	sourceJSON:  streamSource(decodeJSONUsers),
+	sourceJSONL: streamSource(decodeJSONLUsers),
+	sourceCSV:   streamSource(decodeCSVUsers),
+}
+
+var sourceExtensions = map[string]string{
+	".xml":     sourceXML,
+	".json":    sourceJSON,
+	".jsonl":   sourceJSONL,
+	".ndjson":  sourceJSONL,
+	".csv":     sourceCSV,
+	".db":      sourceSQLite,
+	".sqlite":  sourceSQLite,
+	".sqlite3": sourceSQLite,
+}
+
+// sourceFor resolves the format of the dataset at path.
+func sourceFor(path, format string) (string, UserSource, error) {
+	if format == sourceAuto {
+		format = sourceExtensions[strings.ToLower(filepath.Ext(path))]
+		if format == "" {
+			return "", nil, fmt.Errorf("%w: can't tell the format of %s by its extension", errUnknownSourceFormat, path)
+		}
+	}
+
+	source, ok := userSources[format]
+	if !ok {
+		return "", nil, fmt.Errorf("%w %q, known formats: %s", errUnknownSourceFormat, format, strings.Join(sourceFormats(), ", "))
+	}
+	return format, source, nil
+}
+
+func sourceFormats() []string {
+	formats := sortedKeys(userSources)
+	return slices.Insert(formats, 0, sourceAuto)
+}
+
+// aboutTrailer is cut off the end of about, dataset.xml puts a line break
+// before every </about>.
+const aboutTrailer = "\n "
+
+// toUserClient turns a dataset row into the user the API serves.
+func (user UserServer) toUserClient() UserClient {
+	return UserClient{
+		ID:        user.ID,
+		Name:      composeName(user.Name, user.Surname),
+		FirstName: user.Name,
+		LastName:  user.Surname,
+		Age:       user.Age,
+		About:     strings.TrimRight(user.About, aboutTrailer),
+		Gender:    user.Gender,
+		Email:     user.Email,
+		Phone:     user.Phone,
+		Address:   user.Address,
+	}
+}
+
+func decodeXMLDataset(r io.Reader, loader *datasetLoader) error {
+	if loader.lenient {
+		return scanXMLRows(r, func(segment []byte, line, _ int) error {
+			if segment == nil {
+				return loader.rowError(line, errors.New("row is not closed"))
+			}
+			return decodeXMLRow(segment, line, loader)
+		})
+	}
+	return decodeXMLUsers(r, loader)
+}
+
+// decodeXMLUsers decodes one <row> child of the root element at a time.
+func decodeXMLUsers(r io.Reader, loader *datasetLoader) error {
+	return walkXMLRows(r, func(dec *xml.Decoder, start *xml.StartElement) error {
+		row := UserServer{}
+		if err := dec.DecodeElement(&row, start); err != nil {
+			return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+		}
+		loader.add(row.toUserClient())
+		return nil
+	})
+}
+
+// walkXMLRows walks the token stream and calls row for every <row> child of
+// the root element. row must consume the element up to its end tag.
+func walkXMLRows(r io.Reader, row func(dec *xml.Decoder, start *xml.StartElement) error) error {
+	dec := xml.NewDecoder(r)
+	depth := 0
+	seenRoot := false
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) && seenRoot {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errParsingDatasetFailed, err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			seenRoot = true
+			if depth == 1 && tok.Name.Local == "row" {
+				if err = row(dec, &tok); err != nil {
+					return err
+				}
+				continue
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+func parseUsers(data []byte) ([]UserClient, error) {
+	loader := newDatasetLoader()
+	if err := decodeXMLUsers(bytes.NewReader(data), loader); err != nil {
+		return nil, err
+	}
+	return loader.users, nil
+}
+
+// decodeJSONUsers reads a JSON array of rows element by element.
+func decodeJSONUsers(r io.Reader, loader *datasetLoader) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("%w: expected a JSON array of rows", errParsingDatasetFailed)
+	}
+	for dec.More() {
+		row := UserServer{}
+		if err := dec.Decode(&row); err != nil {
+			return fmt.Errorf("%w: row %d: %s", errParsingDatasetFailed, loader.rows.Load()+1, err)
+		}
+		loader.add(row.toUserClient())
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+	}
+	return nil
+}
+
+// decodeJSONLUsers reads one JSON row per line, blank lines are skipped.
+func decodeJSONLUsers(r io.Reader, loader *datasetLoader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		row := UserServer{}
+		if err := json.Unmarshal(data, &row); err != nil {
+			if err = loader.rowError(line, err); err != nil {
+				return err
+			}
+			continue
+		}
+		loader.add(row.toUserClient())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+	}
+	return nil
+}
+
+// decodeCSVUsers reads rows with a header line naming the columns, which may
+// come in any order. The id column is required.
+func decodeCSVUsers(r io.Reader, loader *datasetLoader) error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%w: header: %s", errParsingDatasetFailed, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns[idFieldName]; !ok {
+		return fmt.Errorf("%w: header: no %s column", errParsingDatasetFailed, idFieldName)
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+			err = loader.rowError(parseErr.StartLine, parseErr.Err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", errParsingDatasetFailed, err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		row, err := csvRow(record, columns)
+		if err != nil {
+			if err = loader.rowError(line, err); err != nil {
+				return err
+			}
+			continue
+		}
+		loader.add(row.toUserClient())
+	}
+}
+
+func csvRow(record []string, columns map[string]int) (UserServer, error) {
+	column := func(name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+	number := func(name string) (int, error) {
+		value := strings.TrimSpace(column(name))
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s %q", name, value)
+		}
+		return n, nil
+	}
+
+	id, err := number("id")
+	if err != nil {
+		return UserServer{}, err
+	}
+	age, err := number("age")
+	if err != nil {
+		return UserServer{}, err
+	}
+	return UserServer{
+		ID:      id,
+		Name:    column("first_name"),
+		Surname: column("last_name"),
+		Age:     age,
+		About:   column("about"),
+		Gender:  column("gender"),
+		Email:   column("email"),
+		Phone:   column("phone"),
+		Address: column("address"),
+	}, nil
+}
+
+// scanXMLRows finds rows for lenient XML reads with the same depth walk as
+// walkXMLRows, but over raw tokens, so a broken row doesn't stop the walk: an
+// end tag closes every element opened after the one it names, and after a
+// syntax error tokenizing resumes behind it. Every row is cut out and handed
+// to row with the line and column it starts on, so a broken row costs only
+// itself; a row still open at the end is handed over as nil. Errors outside of
+// rows still fail the walk, as an *xmlPosError.
+func scanXMLRows(r io.Reader, row func(segment []byte, line, column int) error) error {
+	rec := &xmlRecorder{r: bufio.NewReader(r)}
+	dec := xml.NewDecoder(rec)
+	base := int64(0)
+
+	var open []xml.Name
+	seenRoot := false
+	rowStart, rowLine, rowColumn := int64(-1), 0, 0
+	for {
+		if rowStart < 0 {
+			rec.trim(base + dec.InputOffset())
+		}
+		tokStart := base + dec.InputOffset()
+		tok, err := dec.RawToken()
+		if errors.Is(err, io.EOF) && seenRoot {
+			break
+		}
+		if err != nil {
+			if rowStart < 0 {
+				return &xmlPosError{Line: rec.lineAt(tokStart), Column: rec.columnAt(tokStart), err: err}
+			}
+			// the row decoder reports the error, go on right behind it
+			resume := max(base+dec.InputOffset(), tokStart+1)
+			rec.rewind(resume)
+			dec, base = xml.NewDecoder(rec), resume
+			continue
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			seenRoot = true
+			if len(open) == 1 && tok.Name.Local == "row" {
+				rowStart, rowLine, rowColumn = tokStart, rec.lineAt(tokStart), rec.columnAt(tokStart)
+			}
+			open = append(open, tok.Name)
+		case xml.EndElement:
+			i := len(open) - 1
+			for i >= 0 && open[i] != tok.Name {
+				i--
+			}
+			if i < 0 {
+				if rowStart < 0 {
+					return &xmlPosError{
+						Line:   rec.lineAt(tokStart),
+						Column: rec.columnAt(tokStart),
+						err:    fmt.Errorf("unexpected end element </%s>", tok.Name.Local),
+					}
+				}
+				continue
+			}
+			open = open[:i]
+			if rowStart >= 0 && len(open) <= 1 {
+				if err = row(rec.slice(rowStart, base+dec.InputOffset()), rowLine, rowColumn); err != nil {
+					return err
+				}
+				rowStart = -1
+			}
+		}
+	}
+	if rowStart >= 0 {
+		return row(nil, rowLine, rowColumn)
+	}
+	return nil
+}
+
+// xmlPosError is an XML error outside of rows, at the token that starts on
+// Line and Column.
+type xmlPosError struct {
+	Line   int
+	Column int
+	err    error
+}
+
+func (e *xmlPosError) Error() string {
+	return fmt.Sprintf("%s: line %d: %s", errParsingDatasetFailed, e.Line, e.err)
+}
+
+func (e *xmlPosError) Unwrap() []error {
+	return []error{errParsingDatasetFailed, e.err}
+}
+
+// xmlRecorder keeps the bytes the lenient XML loader may still need: the row
+// being read, so it can be decoded on its own, and whatever a failed
+// tokenizer read past the point where tokenizing resumes.
+type xmlRecorder struct {
+	r *bufio.Reader
+	// buf holds the stream from offset start on, pos is the next offset to read
+	buf   []byte
+	start int64
+	pos   int64
+	// lines counts the line breaks before start, column the bytes between the
+	// last of them and start
+	lines  int
+	column int
+}
+
+func (rec *xmlRecorder) ReadByte() (byte, error) {
+	if i := rec.pos - rec.start; i < int64(len(rec.buf)) {
+		rec.pos++
+		return rec.buf[i], nil
+	}
+	b, err := rec.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	rec.buf = append(rec.buf, b)
+	rec.pos++
+	return b, nil
+}
+
+func (rec *xmlRecorder) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := rec.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
+
+// trim forgets the bytes before offset.
+func (rec *xmlRecorder) trim(offset int64) {
+	n := offset - rec.start
+	if n <= 0 {
+		return
+	}
+	rec.lines += bytes.Count(rec.buf[:n], []byte{'\n'})
+	if i := bytes.LastIndexByte(rec.buf[:n], '\n'); i >= 0 {
+		rec.column = int(n) - i - 1
+	} else {
+		rec.column += int(n)
+	}
+	rec.buf = rec.buf[:copy(rec.buf, rec.buf[n:])]
+	rec.start = offset
+}
+
+func (rec *xmlRecorder) rewind(offset int64) {
+	rec.pos = offset
+}
+
+func (rec *xmlRecorder) slice(from, to int64) []byte {
+	return rec.buf[from-rec.start : to-rec.start]
+}
+
+func (rec *xmlRecorder) lineAt(offset int64) int {
+	return rec.lines + 1 + bytes.Count(rec.buf[:offset-rec.start], []byte{'\n'})
+}
+
+// columnAt is the 1-based column of the byte at offset.
+func (rec *xmlRecorder) columnAt(offset int64) int {
+	before := rec.buf[:offset-rec.start]
+	if i := bytes.LastIndexByte(before, '\n'); i >= 0 {
+		return len(before) - i
+	}
+	return rec.column + len(before) + 1
+}
+
+func decodeXMLRow(segment []byte, rowLine int, loader *datasetLoader) error {
+	row := UserServer{}
+	err := xml.Unmarshal(segment, &row)
+	if err == nil {
+		loader.add(row.toUserClient())
+		return nil
+	}
+
+	var syntaxErr *xml.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return loader.rowError(rowLine+syntaxErr.Line-1, errors.New(syntaxErr.Msg))
+	}
+	return loader.rowError(rowLine, err)
+}
+
+// RejectedRow is a malformed row a lenient load skipped.
+type RejectedRow struct {
+	Line   int
+	Reason string
+}
+
+// progressLogRows is how often a load reports its progress to the log.
+const progressLogRows = 100000
+
+// datasetLoader collects the users a UserSource decodes. Every user is indexed
+// as it arrives, so the snapshot is ready as soon as the last row is read.
+// The counters may be read by other goroutines while the load runs.
+type datasetLoader struct {
+	path    string
+	lenient bool
+	users   []UserClient
+	byID    map[int]int
+	// removed is set once a replayed mutation deleted a user
+	removed bool
+	// reserved is set once users and byID were sized for the whole file
+	reserved bool
+
+	rejected      []RejectedRow
+	rejectedTotal int
+
+	rows       atomic.Int64
+	bytesRead  atomic.Int64
+	bytesTotal atomic.Int64
+}
+
+func newDatasetLoader() *datasetLoader {
+	return &datasetLoader{users: []UserClient{}, byID: map[int]int{}, rejected: []RejectedRow{}}
+}
+
+// reserveAfterRows is how many rows a load reads before it sizes the index
+// for the whole file.
+const reserveAfterRows = 1024
+
+func (l *datasetLoader) add(user UserClient) {
+	if len(l.users) == reserveAfterRows && !l.reserved {
+		l.reserve()
+	}
+	l.byID[user.ID] = len(l.users)
+	l.users = append(l.users, user)
+	if rows := l.rows.Add(1); rows%progressLogRows == 0 {
+		progress := l.progress()
+		slog.Info("datasetLoader: Loading dataset", slog.String("path", l.path), slog.Int64("rows", progress.Rows),
+			slog.Int64("bytes_read", progress.BytesRead), slog.Int64("bytes_total", progress.BytesTotal))
+	}
+}
+
+// reserve sizes users and byID for the rows the file is expected to hold, by
+// the bytes the rows so far took. Growing them by doubling would keep two
+// copies alive at once, and the load would need far more memory than the
+// dataset it ends up with.
+func (l *datasetLoader) reserve() {
+	l.reserved = true
+	total, read := l.bytesTotal.Load(), l.bytesRead.Load()
+	if total <= read || read == 0 {
+		return
+	}
+	expected := int(float64(len(l.users)) * float64(total) / float64(read) * 1.25)
+	l.users = slices.Grow(l.users, expected-len(l.users))
+	byID := make(map[int]int, expected)
+	for id, idx := range l.byID {
+		byID[id] = idx
+	}
+	l.byID = byID
+}
+
+// rowError handles a malformed row at line: a strict load fails, a lenient
+// one records the row and goes on.
+func (l *datasetLoader) rowError(line int, reason error) error {
+	if !l.lenient {
+		return fmt.Errorf("%w: line %d: %s", errParsingDatasetFailed, line, reason)
+	}
+
+	l.rejectedTotal++
+	if len(l.rejected) < maxRejectedRows {
+		l.rejected = append(l.rejected, RejectedRow{Line: line, Reason: reason.Error()})
+	}
+	slog.Debug("datasetLoader: Skipping malformed row", slog.String("path", l.path), slog.Int("line", line), slog.String("reason", reason.Error()))
+	return nil
+}
+
+// reader counts the bytes the source consumes from r.
+func (l *datasetLoader) reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, n: &l.bytesRead}
+}
+
+func (l *datasetLoader) snapshot() *usersSnapshot {
+	if l.removed {
+		users := make([]UserClient, 0, len(l.byID))
+		for i, user := range l.users {
+			if idx, ok := l.byID[user.ID]; ok && idx == i {
+				l.byID[user.ID] = len(users)
+				users = append(users, user)
+			}
+		}
+		l.users, l.removed = users, false
+	}
+	next := 0
+	for _, user := range l.users {
+		next = max(next, user.ID+1)
+	}
+	return &usersSnapshot{users: l.users, byID: l.byID, count: len(l.users), next: next, rejected: l.rejected, rejectedTotal: l.rejectedTotal}
+}
+
+// LoadProgress tells how far a running dataset load has got. BytesTotal is
+// zero when the source doesn't read a plain file.
+type LoadProgress struct {
+	Rows       int64
+	BytesRead  int64
+	BytesTotal int64
+}
+
+func (l *datasetLoader) progress() LoadProgress {
+	return LoadProgress{Rows: l.rows.Load(), BytesRead: l.bytesRead.Load(), BytesTotal: l.bytesTotal.Load()}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
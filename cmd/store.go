@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var store = &userStore{}
+
+// reloadInterval is how often requests have the dataset file checked for
+// changes, see -reload-interval. The check and a reload run in the background.
+var reloadInterval = time.Second
+
+// usersSnapshot is an immutable view of a loaded dataset. A write doesn't
+// copy the users: it derives a snapshot that shares them and overlays the
+// users changed since the load, see with. The next load folds the changes in.
+type usersSnapshot struct {
+	// users and byID are the dataset as it was loaded
+	users []UserClient
+	byID  map[int]int
+	// changed overlays users by ID, created lists the IDs of the users
+	// created since the load in order, a deleted user is created again at the end
+	changed map[int]userChange
+	created []int
+	count   int
+	next    int
+
+	// rejected are the malformed rows a lenient load skipped, at most maxRejectedRows of rejectedTotal
+	rejected      []RejectedRow
+	rejectedTotal int
+}
+
+// userChange is the state of a user since the load, user is nil once it's
+// deleted. created is its index in usersSnapshot.created, -1 while it keeps
+// its place among the loaded users.
+type userChange struct {
+	user    *UserClient
+	created int
+}
+
+func (s *usersSnapshot) user(id int) (UserClient, bool) {
+	if change, ok := s.changed[id]; ok {
+		if change.user == nil {
+			return UserClient{}, false
+		}
+		return *change.user, true
+	}
+	idx, ok := s.byID[id]
+	if !ok {
+		return UserClient{}, false
+	}
+	return s.users[idx], true
+}
+
+// list returns the users in dataset order, created ones last. The slice is
+// the caller's to reorder and filter.
+func (s *usersSnapshot) list() []UserClient {
+	if len(s.changed) == 0 {
+		return slices.Clone(s.users)
+	}
+	users := make([]UserClient, 0, s.count)
+	for _, user := range s.users {
+		change, ok := s.changed[user.ID]
+		switch {
+		case !ok:
+			users = append(users, user)
+		case change.user != nil && change.created < 0:
+			users = append(users, *change.user)
+		}
+	}
+	for i, id := range s.created {
+		if change := s.changed[id]; change.user != nil && change.created == i {
+			users = append(users, *change.user)
+		}
+	}
+	return users
+}
+
+// len is the number of users in the snapshot.
+func (s *usersSnapshot) len() int {
+	return s.count
+}
+
+type DatasetStatus struct {
+	Path            string
+	Format          string `json:",omitempty"`
+	Mode            string `json:",omitempty"`
+	Ready           bool
+	Users           int
+	RejectedRows    int
+	LoadedAt        *time.Time `json:",omitempty"`
+	SHA256          string     `json:",omitempty"`
+	LastReloadError string     `json:",omitempty"`
+	LastReloadErrAt *time.Time `json:",omitempty"`
+	// Loading is set while a load is in progress
+	Loading        *LoadProgress `json:",omitempty"`
+	Reloads        int
+	ReloadFailures int
+	// Mutations counts the writes since the server started
+	Mutations   int
+	Compactions int
+	CompactedAt *time.Time `json:",omitempty"`
+}
+
+// DatasetDiagnostics describes the rows of the dataset in service that were
+// not loaded. Rows holds at most maxRejectedRows of RejectedRows.
+type DatasetDiagnostics struct {
+	Path         string
+	Mode         string `json:",omitempty"`
+	RejectedRows int
+	Rows         []RejectedRow
+}
+
+// userStore keeps the parsed dataset in memory and reloads it when the file changes.
+// A failed reload of the same file keeps the previous snapshot in service.
+// loadMu serializes loads, mu guards the fields and is never held while a
+// dataset is being read, so status and the snapshot in service stay
+// available during a long load.
+type userStore struct {
+	loadMu  sync.Mutex
+	loading atomic.Pointer[datasetLoader]
+
+	mu   sync.Mutex
+	path string
+	// requested is the -dataset-format the snapshot was loaded with, format what it resolved to
+	requested string
+	format    string
+	mode      string
+	// checkedAt is when the file was last compared with the snapshot, refreshing is set while a background check runs
+	checkedAt  time.Time
+	refreshing bool
+	modTime    time.Time
+	size       int64
+	snapshot   *usersSnapshot
+	loadedAt   time.Time
+	hash       string
+
+	reloads        int
+	reloadFailures int
+	mutations      int
+	compactions    int
+	compactedAt    time.Time
+
+	lastErr   error
+	lastErrAt time.Time
+	// failure identifies the file version and error of the last failed load
+	failure    string
+	failedMod  time.Time
+	failedSize int64
+}
+
+// current is the snapshot requests are served from. It doesn't touch the
+// file: once reloadInterval has passed since the last check, a background
+// refresh compares the file and reloads it, while requests go on with the
+// snapshot in service. A request that finds nothing to serve loads the file
+// itself, or gets errDatasetLoading if a load is already running; it never
+// waits for another load.
+func (s *userStore) current(path string) (*usersSnapshot, error) {
+	s.mu.Lock()
+	if s.path == path && s.requested == datasetFormat && s.mode == datasetLoadMode && (s.snapshot != nil || s.lastErr != nil) {
+		snapshot, err := s.snapshot, s.lastErr
+		stale := time.Since(s.checkedAt) >= reloadInterval
+		if stale && snapshot != nil && !s.refreshing {
+			s.refreshing = true
+			go s.refresh(path)
+		}
+		s.mu.Unlock()
+		if snapshot != nil {
+			return snapshot, nil
+		}
+		if !stale {
+			return nil, err
+		}
+		return s.tryLoad(path)
+	}
+	s.mu.Unlock()
+	return s.tryLoad(path)
+}
+
+// tryLoad is load for requests: it doesn't wait for a running load.
+func (s *userStore) tryLoad(path string) (*usersSnapshot, error) {
+	if !s.loadMu.TryLock() {
+		if snapshot := s.served(path); snapshot != nil {
+			return snapshot, nil
+		}
+		return nil, errDatasetLoading
+	}
+	defer s.loadMu.Unlock()
+	return s.loadLocked(path)
+}
+
+// loadInBackground starts loading path and returns at once, done gets the
+// result. Requests meanwhile get errDatasetLoading instead of waiting.
+func (s *userStore) loadInBackground(path string) (done <-chan error) {
+	result := make(chan error, 1)
+	s.loadMu.Lock()
+	go func() {
+		_, err := s.loadLocked(path)
+		s.loadMu.Unlock()
+		result <- err
+	}()
+	return result
+}
+
+// served is the snapshot in service if it was loaded from path as configured.
+func (s *userStore) served(path string) *usersSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == path && s.requested == datasetFormat && s.mode == datasetLoadMode {
+		return s.snapshot
+	}
+	return nil
+}
+
+func (s *userStore) refresh(path string) {
+	defer func() {
+		s.mu.Lock()
+		s.refreshing = false
+		s.mu.Unlock()
+	}()
+	s.load(path) //nolint:errcheck
+}
+
+// load checks the file at path and reloads it if it has changed. While
+// another load runs, it returns the snapshot in service instead of waiting.
+func (s *userStore) load(path string) (*usersSnapshot, error) {
+	if !s.loadMu.TryLock() {
+		if snapshot := s.served(path); snapshot != nil {
+			return snapshot, nil
+		}
+		s.loadMu.Lock()
+	}
+	defer s.loadMu.Unlock()
+	return s.loadLocked(path)
+}
+
+// loadLocked is load for callers that already hold loadMu.
+func (s *userStore) loadLocked(path string) (*usersSnapshot, error) {
+	s.mu.Lock()
+	format, source, err := sourceFor(path, datasetFormat)
+	if err != nil {
+		defer s.mu.Unlock()
+		return s.fail(path, nil, err)
+	}
+	info, err := os.Stat(path)
+	s.checkedAt = time.Now()
+	if err != nil {
+		defer s.mu.Unlock()
+		return s.fail(path, nil, err)
+	}
+	same := s.snapshot != nil && s.path == path && s.format == format && s.mode == datasetLoadMode
+	if same && s.modTime.Equal(info.ModTime()) && s.size == info.Size() ||
+		same && s.failedMod.Equal(info.ModTime()) && s.failedSize == info.Size() {
+		defer s.mu.Unlock()
+		return s.snapshot, nil
+	}
+	s.mu.Unlock()
+
+	loader := newDatasetLoader()
+	loader.path = path
+	loader.lenient = datasetLoadMode == loadModeLenient
+	s.loading.Store(loader)
+	err = source.Load(path, loader)
+	if err == nil && mutationLog != "" {
+		err = replayMutations(mutationLog, loader)
+	}
+	s.loading.Store(nil)
+	var hash string
+	if err == nil {
+		hash, err = hashFile(path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, errParsingDatasetFailed) {
+			s.failedMod, s.failedSize = info.ModTime(), info.Size()
+		}
+		return s.fail(path, info, err)
+	}
+
+	s.snapshot = loader.snapshot()
+	s.path, s.requested, s.format, s.mode, s.modTime, s.size = path, datasetFormat, format, datasetLoadMode, info.ModTime(), info.Size()
+	s.loadedAt, s.hash = time.Now(), hash
+	s.lastErr, s.lastErrAt, s.failure = nil, time.Time{}, ""
+	s.reloads++
+	return s.snapshot, nil
+}
+
+// mutate persists the mutation change derives from the dataset at path and
+// puts the changed dataset in service. Loads and other mutations wait, so
+// change sees the latest version. Nothing changes if change or the log fails,
+// or if the mutation leaves the user as it is.
+func (s *userStore) mutate(path string, change func(snapshot *usersSnapshot) (mutation, error)) (*usersSnapshot, error) {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	snapshot, err := s.loadLocked(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := change(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if current, found := snapshot.user(m.ID); found && m.Op == mutationPut && current == m.User.toUserClient() {
+		return snapshot, nil
+	}
+	if err = appendMutation(mutationLog, m); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = snapshot.with(m)
+	s.mutations++
+	return s.snapshot, nil
+}
+
+// compact folds the mutation log into the dataset at path and puts the
+// rewritten dataset in service. Writes wait until it's done.
+func (s *userStore) compact(path string) error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	n, err := compactMutations(path, datasetFormat, mutationLog, datasetLoadMode == loadModeLenient)
+	if err != nil || n == 0 {
+		return err
+	}
+	slog.Info("userStore: Compacted mutation log", slog.String("path", path), slog.Int("mutations", n))
+	s.mu.Lock()
+	s.compactions++
+	s.compactedAt = time.Now()
+	s.mu.Unlock()
+	_, err = s.loadLocked(path)
+	return err
+}
+
+// compactPeriodically runs compaction every interval for the life of the server.
+func compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := store.compact(database); err != nil {
+			slog.Error("compactPeriodically: Failed to compact mutation log", slog.String("path", mutationLog), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// busy reports whether a dataset is being read right now.
+func (s *userStore) busy() bool {
+	return s.loading.Load() != nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fail records a failed load of the file at path, info is nil if it couldn't
+// be read. A failure is counted and logged once per file version and error,
+// not every time a check finds the file still broken.
+func (s *userStore) fail(path string, info os.FileInfo, err error) (*usersSnapshot, error) {
+	failure := path + "\x00" + err.Error()
+	if info != nil {
+		failure += fmt.Sprintf("\x00%d\x00%d", info.ModTime().UnixNano(), info.Size())
+	}
+	repeated := failure == s.failure
+	s.failure, s.lastErr = failure, err
+	if !repeated {
+		s.lastErrAt = time.Now()
+		s.reloadFailures++
+	}
+	if s.snapshot != nil && s.path == path {
+		if !repeated {
+			slog.Warn("userStore: Failed to reload dataset, serving the previous version", slog.String("path", path), slog.String("error", err.Error()))
+		}
+		return s.snapshot, nil
+	}
+
+	s.snapshot, s.path, s.requested, s.format, s.mode, s.hash, s.loadedAt = nil, path, datasetFormat, "", datasetLoadMode, "", time.Time{}
+	return nil, err
+}
+
+func (s *userStore) status() DatasetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := DatasetStatus{
+		Path:           s.path,
+		Format:         s.format,
+		Mode:           s.mode,
+		Ready:          s.snapshot != nil,
+		SHA256:         s.hash,
+		Reloads:        s.reloads,
+		ReloadFailures: s.reloadFailures,
+		Mutations:      s.mutations,
+		Compactions:    s.compactions,
+	}
+	if s.compactions > 0 {
+		compactedAt := s.compactedAt
+		status.CompactedAt = &compactedAt
+	}
+	if s.snapshot != nil {
+		loadedAt := s.loadedAt
+		status.Users = s.snapshot.len()
+		status.RejectedRows = s.snapshot.rejectedTotal
+		status.LoadedAt = &loadedAt
+	}
+	if loader := s.loading.Load(); loader != nil {
+		progress := loader.progress()
+		status.Loading = &progress
+	}
+	if s.lastErr != nil {
+		lastErrAt := s.lastErrAt
+		status.LastReloadError = s.lastErr.Error()
+		status.LastReloadErrAt = &lastErrAt
+	}
+	return status
+}
+
+func (s *userStore) diagnostics() DatasetDiagnostics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	diagnostics := DatasetDiagnostics{Path: s.path, Mode: s.mode, Rows: []RejectedRow{}}
+	if s.snapshot != nil {
+		diagnostics.RejectedRows = s.snapshot.rejectedTotal
+		diagnostics.Rows = s.snapshot.rejected
+	}
+	return diagnostics
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceparentHeader = "traceparent"
+
+var tracer = newTracer(noopExporter{})
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is what travels between processes in the W3C traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// traceparent formats the context as version 00 of https://www.w3.org/TR/trace-context/.
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	sc := SpanContext{}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return SpanContext{}, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return SpanContext{}, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.valid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// SpanData is a finished span as handed over to the exporter.
+type SpanData struct {
+	Name         string
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	Remote       bool
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        string
+}
+
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+type noopExporter struct{}
+
+func (noopExporter) ExportSpan(SpanData) {}
+
+// InMemoryExporter keeps finished spans for inspection in tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *InMemoryExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// LogExporter writes finished spans to the default logger at debug level.
+type LogExporter struct{}
+
+func (LogExporter) ExportSpan(span SpanData) {
+	slog.Debug("span",
+		slog.String("name", span.Name),
+		slog.String("trace_id", span.SpanContext.TraceID.String()),
+		slog.String("span_id", span.SpanContext.SpanID.String()),
+		slog.String("parent_span_id", span.ParentSpanID.String()),
+		slog.Duration("duration", span.End.Sub(span.Start)),
+		slog.Any("attributes", span.Attributes),
+		slog.String("error", span.Error),
+	)
+}
+
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func newTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type Span struct {
+	tracer *Tracer
+
+	mu   sync.Mutex
+	data SpanData
+	done bool
+}
+
+type spanCtxKey struct{}
+
+type remoteSpanCtxKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return span
+}
+
+// contextWithRemoteParent makes spans started from ctx children of a span in another process.
+func contextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanCtxKey{}, sc)
+}
+
+// Start begins a span that is a child of the span in ctx, or of the remote
+// parent put there by contextWithRemoteParent, or a new trace otherwise.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:  name,
+			Start: time.Now(),
+		},
+	}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		span.data.SpanContext = parent.data.SpanContext
+		span.data.ParentSpanID = parent.data.SpanContext.SpanID
+	} else if remote, ok := ctx.Value(remoteSpanCtxKey{}).(SpanContext); ok {
+		span.data.SpanContext = remote
+		span.data.ParentSpanID = remote.SpanID
+		span.data.Remote = true
+	} else {
+		rand.Read(span.data.SpanContext.TraceID[:]) //nolint:errcheck
+		span.data.SpanContext.Sampled = true
+	}
+	rand.Read(span.data.SpanContext.SpanID[:]) //nolint:errcheck
+
+	return context.WithValue(ctx, spanCtxKey{}, span), span
+}
+
+func (s *Span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+// withTracing starts the server span, continuing the trace from the traceparent header.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = contextWithRemoteParent(ctx, sc)
+		}
+
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method)
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttribute("http.route", requestInfoFromContext(ctx).routeName())
+		span.SetAttribute("http.status_code", rec.status())
+	})
+}
+
+// traced runs fn inside a child span of the span in ctx.
+func traced(ctx context.Context, name string, fn func()) {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+	fn()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxBatchIDs = 100
+
+var (
+	errBadIDParam   = errors.New("bad id param")
+	errBadIDsParam  = errors.New("bad ids param")
+	errUserNotFound = errors.New("user not found")
+)
+
+type BatchUsersServer struct {
+	Users    []userView
+	NotFound []int
+}
+
+func (resp BatchUsersServer) resultSize() int { return len(resp.Users) }
+
+// GetUserServer serves a single user at /users/{id}.
+func GetUserServer(w http.ResponseWriter, r *http.Request) {
+	withRecovery(requireAuth(scopeUsersRead, getUser)).ServeHTTP(w, r)
+}
+
+// GetUsersServer serves a batch of users at /users?ids=1,2,3.
+func GetUsersServer(w http.ResponseWriter, r *http.Request) {
+	withRecovery(requireAuth(scopeUsersRead, getUsers)).ServeHTTP(w, r)
+}
+
+func getUser(w http.ResponseWriter, r *http.Request) {
+	view := viewFromContext(r.Context())
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		sendProblem(w, r, errBadIDParam)
+		return
+	}
+
+	requestInfoFromContext(r.Context()).setParams(map[string]interface{}{"id": id})
+
+	snapshot, ok := loadDataset(w, r)
+	if !ok {
+		return
+	}
+
+	user, found := snapshot.user(id)
+	if !found {
+		sendProblem(w, r, errUserNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	sendJSON(w, r, userView{user: user, view: view})
+}
+
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	view := viewFromContext(r.Context())
+	ids, err := parseIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		sendProblem(w, r, err)
+		return
+	}
+
+	requestInfoFromContext(r.Context()).setParams(map[string]interface{}{"ids": ids})
+
+	snapshot, ok := loadDataset(w, r)
+	if !ok {
+		return
+	}
+
+	resp := BatchUsersServer{Users: make([]userView, 0, len(ids)), NotFound: []int{}}
+	for _, id := range ids {
+		user, found := snapshot.user(id)
+		if !found {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.Users = append(resp.Users, userView{user: user, view: view})
+	}
+
+	sendJSON(w, r, resp)
+}
+
+func parseIDs(rawIDs string) ([]int, error) {
+	if rawIDs == "" {
+		return nil, errBadIDsParam
+	}
+
+	parts := strings.Split(rawIDs, ",")
+	if len(parts) > maxBatchIDs {
+		return nil, errBadIDsParam
+	}
+
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, errBadIDsParam
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+
+	minUserAge = 0
+	maxUserAge = 150
+
+	// registeredLayout is the layout of <registered> in dataset.xml
+	registeredLayout = "2006-01-02T15:04:05 -07:00"
+)
+
+var (
+	// datasetElements are the row elements of dataset.xml in document order,
+	// the ones UserServer reads are required.
+	datasetElements = []string{
+		"id", "guid", "isActive", "balance", "picture", "age", "eyeColor", "first_name", "last_name",
+		"gender", "company", "email", "phone", "address", "about", "registered", "favoriteFruit",
+	}
+	requiredElements = []string{"id", "first_name", "last_name", "age", "about", "gender", "email", "phone", "address"}
+	validGenders     = []string{"male", "female"}
+)
+
+// DatasetIssue is a problem validate found in a dataset. Column is set for
+// syntax errors only.
+type DatasetIssue struct {
+	Line     int
+	Column   int
+	Severity string
+	Message  string
+}
+
+// datasetValidator checks the rows of an XML dataset and collects statistics
+// about their fields. Rows are walked with the same code the server loads them
+// with, so a dataset that validates also loads.
+type datasetValidator struct {
+	issues []DatasetIssue
+	rows   int
+	ids    map[int]int
+
+	fields  map[string]*fieldStats
+	ages    []int
+	genders map[string]int
+}
+
+type fieldStats struct {
+	present  int
+	empty    int
+	distinct map[string]struct{}
+}
+
+// xmlElement is an element of a row with the line it starts on.
+type xmlElement struct {
+	name  string
+	value string
+	line  int
+}
+
+func newDatasetValidator() *datasetValidator {
+	v := &datasetValidator{ids: map[int]int{}, fields: map[string]*fieldStats{}, genders: map[string]int{}}
+	for _, name := range datasetElements {
+		v.fields[name] = &fieldStats{distinct: map[string]struct{}{}}
+	}
+	return v
+}
+
+func (v *datasetValidator) report(line int, severity, format string, args ...any) {
+	v.issues = append(v.issues, DatasetIssue{Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// reportSyntax reports a syntax error at line and column.
+func (v *datasetValidator) reportSyntax(line, column int, msg string) {
+	v.issues = append(v.issues, DatasetIssue{Line: line, Column: column, Severity: severityError, Message: msg})
+}
+
+// validate reads the whole dataset. Rows are cut out the way lenient loads do
+// it, so a syntax error in a row is reported and the walk goes on with the
+// next one. Only a syntax error outside of rows ends it.
+func (v *datasetValidator) validate(r io.Reader) {
+	err := scanXMLRows(r, func(segment []byte, line, column int) error {
+		if segment == nil {
+			v.reportSyntax(line, column, "row is not closed")
+			return nil
+		}
+		v.rowSegment(segment, line, column)
+		return nil
+	})
+
+	var posErr *xmlPosError
+	var syntaxErr *xml.SyntaxError
+	switch {
+	case errors.As(err, &posErr) && errors.As(err, &syntaxErr):
+		v.reportSyntax(posErr.Line, posErr.Column, syntaxErr.Msg)
+	case errors.As(err, &posErr):
+		v.reportSyntax(posErr.Line, posErr.Column, posErr.err.Error())
+	case err != nil:
+		v.report(0, severityError, "%s", err)
+	}
+}
+
+// rowSegment checks a row cut out of the dataset at line and column.
+func (v *datasetValidator) rowSegment(segment []byte, line, column int) {
+	dec := xml.NewDecoder(bytes.NewReader(segment))
+	_, err := dec.Token()
+	if err == nil {
+		err = v.row(dec, line)
+	}
+	var syntaxErr *xml.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return
+	}
+
+	// the column is that of the last byte the decoder read before giving up
+	offset := int(dec.InputOffset())
+	if i := bytes.LastIndexByte(segment[:offset], '\n'); i >= 0 {
+		column = offset - i - 1
+	} else {
+		column += offset - 1
+	}
+	v.reportSyntax(line+syntaxErr.Line-1, column, syntaxErr.Msg)
+}
+
+// row walks the elements of a row whose start tag is on rowLine.
+func (v *datasetValidator) row(dec *xml.Decoder, rowLine int) error {
+	elements := make([]xmlElement, 0, len(datasetElements))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			line, _ := dec.InputPos()
+			line += rowLine - 1
+			value, err := elementText(dec, tok)
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				v.report(line, severityError, "element <%s> must not have child elements", tok.Name.Local)
+				continue
+			}
+			elements = append(elements, xmlElement{name: tok.Name.Local, value: *value, line: line})
+		case xml.EndElement:
+			v.rows++
+			v.checkRow(rowLine, elements)
+			return nil
+		}
+	}
+}
+
+// elementText reads the text of a leaf element up to its end tag, nil means
+// the element had children.
+func elementText(dec *xml.Decoder, start xml.StartElement) (*string, error) {
+	text := &strings.Builder{}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			text.Write(tok)
+		case xml.StartElement:
+			if err = dec.Skip(); err != nil {
+				return nil, err
+			}
+			if err = dec.Skip(); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		case xml.EndElement:
+			value := text.String()
+			return &value, nil
+		}
+	}
+}
+
+func (v *datasetValidator) checkRow(rowLine int, elements []xmlElement) {
+	seen := map[string]int{}
+	for _, element := range elements {
+		if !slices.Contains(datasetElements, element.name) {
+			v.report(element.line, severityError, "unknown element <%s>", element.name)
+			continue
+		}
+		if first, ok := seen[element.name]; ok {
+			v.report(element.line, severityError, "element <%s> repeats the one on line %d", element.name, first)
+			continue
+		}
+		seen[element.name] = element.line
+		v.checkElement(element)
+	}
+	for _, name := range requiredElements {
+		if _, ok := seen[name]; !ok {
+			v.report(rowLine, severityError, "row has no <%s> element", name)
+		}
+	}
+}
+
+func (v *datasetValidator) checkElement(element xmlElement) {
+	stats := v.fields[element.name]
+	stats.present++
+	if strings.TrimSpace(element.value) == "" {
+		stats.empty++
+	}
+	stats.distinct[element.value] = struct{}{}
+
+	line, value := element.line, element.value
+	switch element.name {
+	case "id":
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			v.report(line, severityError, "id %q is not an integer", value)
+			return
+		}
+		if first, ok := v.ids[id]; ok {
+			v.report(line, severityError, "duplicate id %d, first seen on line %d", id, first)
+			return
+		}
+		v.ids[id] = line
+	case "age":
+		age, err := strconv.Atoi(value)
+		if err != nil {
+			v.report(line, severityError, "age %q is not an integer", value)
+			return
+		}
+		if !validAge(age) {
+			v.report(line, severityError, "age %d is out of range %d..%d", age, minUserAge, maxUserAge)
+			return
+		}
+		v.ages = append(v.ages, age)
+	case "gender":
+		if !slices.Contains(validGenders, value) {
+			v.report(line, severityError, "gender %q is not one of %s", value, strings.Join(validGenders, ", "))
+			return
+		}
+		v.genders[value]++
+	case "email":
+		if !validEmail(value) {
+			v.report(line, severityError, "malformed email %q", value)
+		}
+	case "registered":
+		if _, err := time.Parse(registeredLayout, value); err != nil {
+			v.report(line, severityError, "malformed date %q, want the layout %q", value, registeredLayout)
+		}
+	case "about":
+		// the line break dataset.xml ends every about with is dropped on load
+		value = strings.TrimRight(value, aboutTrailer)
+		if strings.TrimRightFunc(value, unicode.IsSpace) != value {
+			v.report(line, severityWarning, "about has trailing whitespace")
+		}
+	}
+}
+
+func validAge(age int) bool {
+	return age >= minUserAge && age <= maxUserAge
+}
+
+// validEmail accepts a bare address, without a display name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+func (v *datasetValidator) count(severity string) int {
+	n := 0
+	for _, issue := range v.issues {
+		if issue.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// writeSummary prints the issue counts and the statistics of every field.
+func (v *datasetValidator) writeSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "rows: %d, errors: %d, warnings: %d\n\n", v.rows, v.count(severityError), v.count(severityWarning))
+	fmt.Fprintln(tw, "field\tpresent\tempty\tdistinct")
+	for _, name := range datasetElements {
+		stats := v.fields[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", name, stats.present, stats.empty, len(stats.distinct))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(v.ages) > 0 {
+		sum := 0
+		for _, age := range v.ages {
+			sum += age
+		}
+		fmt.Fprintf(w, "\nage: min %d, max %d, mean %.1f\n", slices.Min(v.ages), slices.Max(v.ages), float64(sum)/float64(len(v.ages)))
+	}
+	genders := make([]string, 0, len(validGenders))
+	for _, gender := range validGenders {
+		genders = append(genders, fmt.Sprintf("%s %d", gender, v.genders[gender]))
+	}
+	_, err := fmt.Fprintf(w, "gender: %s\n", strings.Join(genders, ", "))
+	return err
+}
+
+// runValidate is the validate command. It prints every issue as
+// path:line: severity: message, or path:line:column: for syntax errors, followed by a summary and returns the exit
+// code: 0 for a valid dataset, 1 if it has errors, or warnings with -strict,
+// 2 if it can't be read.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	strict := flags.Bool("strict", false, "fail on warnings too")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: search-server validate [-strict] [dataset.xml]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+	path := database
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "validate: %s\n", err)
+		return 2
+	}
+	defer f.Close()
+
+	v := newDatasetValidator()
+	v.validate(f)
+	for _, issue := range v.issues {
+		position := strconv.Itoa(issue.Line)
+		if issue.Column > 0 {
+			position += ":" + strconv.Itoa(issue.Column)
+		}
+		fmt.Fprintf(stdout, "%s:%s: %s: %s\n", path, position, issue.Severity, issue.Message)
+	}
+	if len(v.issues) > 0 {
+		fmt.Fprintln(stdout)
+	}
+	if err = v.writeSummary(stdout); err != nil {
+		fmt.Fprintf(stderr, "validate: %s\n", err)
+		return 2
+	}
+
+	if v.count(severityError) > 0 || *strict && v.count(severityWarning) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	scopeUsersWrite = "users:write"
+
+	maxUserBodySize = 64 << 10
+)
+
+var (
+	errBadUser              = errors.New("bad user")
+	errUserExists           = errors.New("user already exists")
+	errPreconditionRequired = errors.New("If-Match header is required")
+	errPreconditionFailed   = errors.New("user was changed, If-Match doesn't match")
+	errWritesDisabled       = errors.New("writes are disabled")
+)
+
+// etagKey keys the ETags. Without it a caller could hash guessed values of
+// the fields it can't read and compare the result with the ETag. A new key is
+// drawn on every start, ETags of an earlier run then no longer match.
+var etagKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("etagKey: %s", err))
+	}
+	return key
+}()
+
+// userETag is a strong validator of the user as it is stored, so any change
+// of the row gives a new one.
+func userETag(user UserClient) string {
+	row, _ := json.Marshal(user.toUserServer()) //nolint:errcheck
+	mac := hmac.New(sha256.New, etagKey)
+	mac.Write(row)
+	return strconv.Quote(hex.EncodeToString(mac.Sum(nil)[:16]))
+}
+
+// checkPrecondition enforces optimistic concurrency: a change must name the
+// version of the user it was made against in If-Match, * matches any version.
+// The ETag of a compressed response names the same version.
+func checkPrecondition(r *http.Request, user UserClient) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return errPreconditionRequired
+	}
+	etag := userETag(user)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = decodedETag(strings.TrimSpace(candidate))
+		if candidate == "*" || candidate == etag {
+			return nil
+		}
+	}
+	return errPreconditionFailed
+}
+
+// userBodyKeys maps the keys a user body may have to the fields they set.
+// Bodies take the dataset names (first_name) as well as the keys of the users
+// the API serves (FirstName), so a user that was read can be written back.
+// Keys must match exactly: the JSON decoder would match them in any case and
+// slip past the access check. The composed name is derived and not written.
+var userBodyKeys = func() map[string]string {
+	keys := map[string]string{}
+	for _, field := range userFields {
+		keys[field.JSONKey] = field.Name
+		if field.Name != nameFieldName {
+			keys[field.Name] = field.Name
+		}
+	}
+	return keys
+}()
+
+// decodeUserBody merges the JSON object in the body into row. A null member
+// clears the field, as in a JSON merge patch (RFC 7396). Fields the caller
+// can't read can't be written either, except for sending back the redacted
+// value it was served, which keeps the field. Only a created user may pick
+// its ID, an existing one keeps it.
+func decodeUserBody(w http.ResponseWriter, r *http.Request, row *UserServer, create bool) error {
+	if mediaType := r.Header.Get("Content-Type"); mediaType != "" && !strings.HasPrefix(mediaType, "application/json") &&
+		!strings.HasPrefix(mediaType, "application/merge-patch+json") {
+		return errBadRequestBody
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUserBodySize))
+	if err != nil {
+		return errBadRequestBody
+	}
+
+	keys := map[string]json.RawMessage{}
+	if err = json.Unmarshal(body, &keys); err != nil {
+		return errBadRequestBody
+	}
+
+	var errs validationErrors
+	view := viewFromContext(r.Context())
+	fields := map[string]json.RawMessage{}
+	for _, key := range sortedKeys(keys) {
+		name, ok := userBodyKeys[key]
+		switch {
+		case !ok:
+			return errBadRequestBody
+		case name == nameFieldName:
+			continue
+		case fields[name] != nil:
+			errs = append(errs, &paramError{err: errBadUser, name: name, reason: "is given twice"})
+		case view.restricted[name] && accessPolicy.Fields[name].Action == fieldActionRedact && string(keys[key]) == strconv.Quote(redactedValue):
+			continue
+		case view.restricted[name]:
+			errs = append(errs, &paramError{err: errBadUser, name: name, reason: "can't be written without the " + accessPolicy.Fields[name].Scope + " scope"})
+		}
+		fields[name] = keys[key]
+	}
+	for name, value := range fields {
+		if string(value) == "null" {
+			copyUserField(row, &UserServer{}, name)
+			delete(fields, name)
+		}
+	}
+
+	id := row.ID
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return errBadRequestBody
+	}
+	dec := json.NewDecoder(bytes.NewReader(canonical))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(row); err != nil {
+		return errBadRequestBody
+	}
+
+	if !create && row.ID != id {
+		errs = append(errs, &paramError{err: errBadUser, name: idFieldName, reason: fmt.Sprintf("must be %d, the ID can't be changed", id)})
+	}
+	checkUserRow(*row, &errs)
+	return errs.err()
+}
+
+// checkUserRow applies the rules validate checks datasets with.
+func checkUserRow(row UserServer, errs *validationErrors) {
+	if strings.TrimSpace(row.Name) == "" && strings.TrimSpace(row.Surname) == "" {
+		*errs = append(*errs, &paramError{err: errBadUser, name: firstNameFieldName, reason: "first_name or last_name must be set"})
+	}
+	if !validAge(row.Age) {
+		*errs = append(*errs, &paramError{err: errBadUser, name: ageFieldName, reason: fmt.Sprintf("must be in range %d..%d", minUserAge, maxUserAge)})
+	}
+	if !slices.Contains(validGenders, row.Gender) {
+		*errs = append(*errs, &paramError{err: errBadUser, name: genderFieldName, reason: "must be one of " + strings.Join(validGenders, ", ")})
+	}
+	if row.Email != "" && !validEmail(row.Email) {
+		*errs = append(*errs, &paramError{err: errBadUser, name: emailFieldName, reason: fmt.Sprintf("%q is not an email address", row.Email)})
+	}
+}
+
+// writeUser runs a write of the user with the ID in the path. update builds
+// the new row from the current user, found tells whether there is one.
+func writeUser(w http.ResponseWriter, r *http.Request, update func(current UserClient, found bool) (mutation, error)) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		sendProblem(w, r, errBadIDParam)
+		return
+	}
+	requestInfoFromContext(r.Context()).setParams(map[string]interface{}{"id": id})
+
+	mutateUsers(w, r, func(snapshot *usersSnapshot) (mutation, error) {
+		current, found := snapshot.user(id)
+		return update(current, found)
+	})
+}
+
+// mutateUsers persists the change and answers with the user it leaves behind,
+// or with 204 if the user is gone.
+func mutateUsers(w http.ResponseWriter, r *http.Request, change func(snapshot *usersSnapshot) (mutation, error)) {
+	if mutationLog == "" {
+		sendProblem(w, r, errWritesDisabled)
+		return
+	}
+
+	var m mutation
+	var changed bool
+	var changeErr error
+	snapshot, err := store.mutate(database, func(snapshot *usersSnapshot) (mutation, error) {
+		changed = true
+		m, changeErr = change(snapshot)
+		return m, changeErr
+	})
+	switch {
+	case err == nil:
+	case changeErr != nil, errors.Is(err, errParsingDatasetFailed):
+		sendProblem(w, r, err)
+		return
+	case !changed:
+		loggerFromContext(r.Context()).Error("mutateUsers: Failed to read dataset", slog.String("path", database), slog.String("error", err.Error()))
+		sendProblem(w, r, errDatasetNotLoaded)
+		return
+	default:
+		loggerFromContext(r.Context()).Error("mutateUsers: Failed to persist mutation", slog.String("path", mutationLog), slog.String("error", err.Error()))
+		sendProblem(w, r, errInternal)
+		return
+	}
+
+	user, found := snapshot.user(m.ID)
+	if !found {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("ETag", userETag(user))
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		w.Header().Set("Location", "/v1/users/"+strconv.Itoa(user.ID))
+		status = http.StatusCreated
+	}
+	sendJSONStatus(w, r, status, userView{user: user, view: viewFromContext(r.Context())})
+}
+
+// createUser adds a user. Without an id in the body it gets the next free one.
+func createUser(w http.ResponseWriter, r *http.Request) {
+	mutateUsers(w, r, func(snapshot *usersSnapshot) (mutation, error) {
+		row := UserServer{ID: -1}
+		if err := decodeUserBody(w, r, &row, true); err != nil {
+			return mutation{}, err
+		}
+		if row.ID == -1 {
+			row.ID = snapshot.nextID()
+		}
+		if _, found := snapshot.user(row.ID); found {
+			return mutation{}, errUserExists
+		}
+		return mutation{Op: mutationPut, ID: row.ID, User: &row}, nil
+	})
+}
+
+// replaceUser overwrites every field of the user the caller can read, the
+// ones it can't read keep their values.
+func replaceUser(w http.ResponseWriter, r *http.Request) {
+	writeUser(w, r, func(current UserClient, found bool) (mutation, error) {
+		if !found {
+			return mutation{}, errUserNotFound
+		}
+		if err := checkPrecondition(r, current); err != nil {
+			return mutation{}, err
+		}
+
+		stored := current.toUserServer()
+		row := UserServer{ID: stored.ID}
+		for name := range viewFromContext(r.Context()).restricted {
+			copyUserField(&row, &stored, name)
+		}
+		if err := decodeUserBody(w, r, &row, false); err != nil {
+			return mutation{}, err
+		}
+		return mutation{Op: mutationPut, ID: row.ID, User: &row}, nil
+	})
+}
+
+// copyUserField copies the field name from src to dst.
+func copyUserField(dst, src *UserServer, name string) {
+	switch name {
+	case firstNameFieldName:
+		dst.Name = src.Name
+	case lastNameFieldName:
+		dst.Surname = src.Surname
+	case ageFieldName:
+		dst.Age = src.Age
+	case aboutFieldName:
+		dst.About = src.About
+	case genderFieldName:
+		dst.Gender = src.Gender
+	case emailFieldName:
+		dst.Email = src.Email
+	case phoneFieldName:
+		dst.Phone = src.Phone
+	case addressFieldName:
+		dst.Address = src.Address
+	}
+}
+
+// patchUser changes the fields present in the body, JSON merge patch style.
+func patchUser(w http.ResponseWriter, r *http.Request) {
+	writeUser(w, r, func(current UserClient, found bool) (mutation, error) {
+		if !found {
+			return mutation{}, errUserNotFound
+		}
+		if err := checkPrecondition(r, current); err != nil {
+			return mutation{}, err
+		}
+
+		row := current.toUserServer()
+		if err := decodeUserBody(w, r, &row, false); err != nil {
+			return mutation{}, err
+		}
+		return mutation{Op: mutationPut, ID: row.ID, User: &row}, nil
+	})
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	writeUser(w, r, func(current UserClient, found bool) (mutation, error) {
+		if !found {
+			return mutation{}, errUserNotFound
+		}
+		if err := checkPrecondition(r, current); err != nil {
+			return mutation{}, err
+		}
+		return mutation{Op: mutationDelete, ID: current.ID}, nil
+	})
+}
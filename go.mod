@@ -1,10 +1,12 @@
 module github.com/Benzogang-Tape/Search-Server
 
-go 1.21.3
+go 1.22
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/text v0.22.0
 )
 
 require (